@@ -6,11 +6,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
@@ -23,12 +25,12 @@ import (
 const (
 	exitCodeNoService int = iota
 	exitCodeWrongServer
+	exitCodeBadProfiles
+	exitCodeBadResolver
 )
 
 const (
 	appName = "portscan"
-	// threads could be a user input, if desired; easy change.
-	threads = 10
 
 	noInput = "No input received; ? for help."
 )
@@ -38,16 +40,43 @@ var (
 	serviceip  = flag.String("serviceip", "",
 		"IP address or hostname for the portscanservice. "+
 			"Default is for this app to run the scan without use of the service.")
+	servicePort = flag.String("serviceport", scan.DefaultServicePort,
+		"Port of the portscanservice, when serviceip is given.")
+	profilesFile = flag.String("profiles", "",
+		"JSON file of user defined scan profiles, in addition to the built in profiles.")
+	resolverAddress = flag.String("resolver", "",
+		"DNS server (host or host:port) for reverse lookups in standalone mode. Default is the system resolver.")
 	// port is the string representation of the integer port number, no leading ":"
 	port            string
 	ips             []string
 	results         scan.Results
 	pendingResultID string
+	// previousResults and previousResultID are those of the scan executed before the last, for diff.
+	previousResults  scan.Results
+	previousResultID string
+	// started and finished are the start and end of the last standalone scan, for results --summary.
+	started  time.Time
+	finished time.Time
+	// budget is the time limit for a whole scan; zero for no limit.
+	budget time.Duration
 
 	prompt = appName + ">"
 
-	// timeout is timeout for scan requests.
-	timeout = time.Duration(2) * time.Second
+	// profiles are the scan profiles that may be selected with setprofile.
+	profiles = scan.Profiles
+	// profile is the selected profile, and settings are its settings plus any overrides.
+	profile  = scan.DefaultProfile
+	settings = scan.Profiles[scan.DefaultProfile]
+	// overrides are the values of the settings overridden since the profile was selected, by
+	// command, I.E. setthreads, for scans executed by the service.
+	overrides = map[string]string{}
+
+	// rdns adds hostnames to results from reverse lookups, using resolver.
+	rdns     bool
+	resolver = net.DefaultResolver
+
+	// priority is the priority of scans executed by the service; empty to let the service choose.
+	priority = ""
 )
 
 func main() {
@@ -59,9 +88,21 @@ func main() {
 	}()
 
 	flag.Parse()
+	var err error
+	profiles, err = scan.LoadProfiles(*profilesFile)
+	if err != nil {
+		fmt.Printf("Error: loading profiles, error: %+v\n", err)
+		os.Exit(exitCodeBadProfiles)
+	}
+	resolver, err = scan.NewResolver(*resolverAddress)
+	if err != nil {
+		fmt.Printf("Error: creating resolver, error: %+v\n", err)
+		os.Exit(exitCodeBadResolver)
+	}
+
 	if serviceip != nil && *serviceip != "" {
 		// Verify the provided IP is the service. Send a query string to prevent an error in the log.
-		resp, err := http.Get(fmt.Sprintf("http://%s:%s/", *serviceip, scan.DefaultServicePort))
+		resp, err := http.Get(fmt.Sprintf("http://%s:%s/", *serviceip, *servicePort))
 		if err != nil {
 			fmt.Printf("Error: error GETting service, error: %+v\n", err)
 			os.Exit(exitCodeNoService)
@@ -71,7 +112,7 @@ func main() {
 			fmt.Println("Error: The response was not from the appropriate service.")
 			os.Exit(exitCodeWrongServer)
 		}
-		serviceurl = fmt.Sprintf("http://%s:%s/", *serviceip, scan.DefaultServicePort)
+		serviceurl = fmt.Sprintf("http://%s:%s/", *serviceip, *servicePort)
 		fmt.Printf("\nService IP provided; serviceurl: %s\n", serviceurl)
 	} else {
 		fmt.Println("\nNo service IP provided; running standalone.")
@@ -93,7 +134,21 @@ func execute(port string, ips []string) {
 		return
 	}
 
-	results = scan.Scan(port, ips, threads, timeout)
+	ctx, cancel := context.Background(), func() {}
+	if budget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, budget)
+	}
+	defer cancel()
+	previousResults = results
+	started = time.Now()
+	results = scan.Scan(ctx, port, ips, settings, func(p scan.Progress, r scan.Result) {
+		fmt.Printf("\r%s", p)
+	})
+	finished = time.Now()
+	fmt.Println()
+	if rdns {
+		scan.ReverseLookup(context.Background(), results, resolver, scan.DefaultLookupConcurrency)
+	}
 }
 
 // help dumps user help for the CLI.
@@ -105,15 +160,37 @@ func help() {
 	fmt.Println("")
 	fmt.Println("See the README for general setup.")
 	fmt.Println("Commands available:")
+	fmt.Println("cancel - cancels a scan executed by the service; results collected so far are kept.")
+	fmt.Println("diff - shows the ports that opened, closed or changed state between the last two scans executed.")
+	fmt.Println("    With the service, diff FROM_ID TO_ID compares two scans, and diff SCHEDULE_ID compares the")
+	fmt.Println("    last two completed runs of a schedule.")
 	fmt.Println("execute - executes a scan of provide IPs and port.")
+	fmt.Println("pause - pauses a scan executed by the service; no probes are sent until resume.")
 	fmt.Println("results - dumps results output.")
+	fmt.Println("    results --summary shows counts per state, open ports per host, top open ports, error")
+	fmt.Println("    categories, and the duration and rate of the scan, instead of every result.")
+	fmt.Println("resume - resumes a paused scan executed by the service.")
+	fmt.Println("setbudget - input a time limit for the whole scan (I.E. 5m, or integer seconds); 0 for no limit.")
+	fmt.Println("    Targets not probed within the budget are reported as not scanned.")
 	fmt.Println("setips - input a list of space separated IP addresses.")
 	fmt.Println("setport - input a single port number.")
+	fmt.Println("setpriority - input interactive or batch; the priority of scans executed by the service.")
+	fmt.Println("    By default the service chooses, by the number of IPs; large scans are batch.")
+	fmt.Println("setrdns - input on or off; on adds hostnames from reverse DNS lookups to results.")
+	fmt.Printf("setprofile - input a profile name that sets threads, timeout, retries and rate; profiles: %s.\n",
+		strings.Join(scan.ProfileNames(profiles), ", "))
+	fmt.Println("    With no profile name, shows the current profile and settings.")
+	fmt.Println("setthreads, settimeout, setretries, setrate - override a single setting of the profile.")
+	fmt.Println("    The service rejects overrides outside the limits set by its operator.")
+	fmt.Println("status - shows the state, progress and queue position of a scan executed by the service.")
+	fmt.Println("watch - shows the results of a scan executed by the service as they complete, until it is done.")
 	fmt.Println("")
 }
 
-// getToService does the GET to the service when the service is being service requests
-func getToService(qs string) {
+// getToService does the GET to the service when the service is being service requests; cmd is the
+// CLI command, which determines the type of the response. Only an accepted execute returns the ID
+// of a new scan, which becomes the pending scan.
+func getToService(cmd string, qs string) {
 	fmt.Printf("%s is being used to service this request.\n", scan.ServiceAppName)
 	resp, err := http.Get(fmt.Sprintf("%s?%s", serviceurl, qs))
 	if err != nil {
@@ -128,23 +205,128 @@ func getToService(qs string) {
 		fmt.Printf("ERROR: getting body: %+v\n", err)
 	}
 
-	id := scan.ID{}
-	json.Unmarshal(body, &id)
-	if id.ID != "" {
-		pendingResultID = id.ID
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		fmt.Printf("%s\n", strings.TrimSpace(string(body)))
+		return
+	}
+	switch cmd {
+	case "execute":
+		id := scan.ID{}
+		if err := json.Unmarshal(body, &id); err != nil || id.ID == "" || resp.StatusCode != http.StatusAccepted {
+			fmt.Printf("ERROR: unexpected response to execute, status: %d, response: %s\n", resp.StatusCode, body)
+			return
+		}
+		previousResultID, pendingResultID = pendingResultID, id.ID
+		return
+	case "cancel", "pause", "resume", "status":
+		job := scan.Job{}
+		if err := json.Unmarshal(body, &job); err != nil {
+			fmt.Printf("ERROR: unmarshaling %s response, error: %+v\n", cmd, err)
+			return
+		}
+		fmt.Printf("%s\n", job)
 		return
 	}
 
+	if resp.Header.Get(scan.PartialHeader) == "true" {
+		fmt.Printf("Partial results; scan is %s%% complete.\n", resp.Header.Get(scan.PercentHeader))
+	}
+	if cmd == "summary" {
+		summary := scan.Summary{}
+		if err := json.Unmarshal(body, &summary); err != nil {
+			fmt.Printf("ERROR: unmarshaling summary response, error: %+v\n", err)
+			return
+		}
+		fmt.Printf("%s", summary)
+		return
+	}
 	if len(body) != 0 && strings.TrimSpace(string(body)) != "" {
 		fmt.Printf("%s\n", body)
 	}
-	return
+}
+
+// getDiffFromService GETs a scan.ResultsDiff from the v2 API path of the service, and prints it.
+func getDiffFromService(path string) {
+	fmt.Printf("%s is being used to service this request.\n", scan.ServiceAppName)
+	resp, err := http.Get(serviceurl + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		fmt.Printf("ERROR: error GETting path: %s, error: %+v\n", path, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("ERROR: getting body: %+v\n", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := scan.APIError{}
+		json.Unmarshal(body, &apiErr)
+		fmt.Printf("ERROR: status: %d, error: %s\n", resp.StatusCode, apiErr.Error)
+		return
+	}
+	d := scan.ResultsDiff{}
+	if err := json.Unmarshal(body, &d); err != nil {
+		fmt.Printf("ERROR: parsing diff, error: %+v\n", err)
+		return
+	}
+	fmt.Printf("%s", d)
+}
+
+// watchService prints the events of the scan with the specified ID from the service, until the
+// scan is done.
+func watchService(id string) {
+	fmt.Printf("%s is being used to service this request.\n", scan.ServiceAppName)
+	resp, err := http.Get(fmt.Sprintf("%sv2/scans/%s/events", serviceurl, id))
+	if err != nil {
+		fmt.Printf("ERROR: error GETting events of scan: %s, error: %+v\n", id, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := scan.APIError{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Printf("ERROR: status: %d, error: %s\n", resp.StatusCode, apiErr.Error)
+		return
+	}
+
+	// The progress line is overwritten by each event; progress is the last one printed.
+	progress := ""
+	clearProgress := func() {
+		fmt.Printf("\r%s\r", strings.Repeat(" ", len(progress)))
+		progress = ""
+	}
+	err = scan.ReadStream(resp.Body, func(ev scan.StreamEvent) bool {
+		switch ev.Event {
+		case scan.StreamState, scan.StreamDone:
+			job := scan.Job{}
+			json.Unmarshal([]byte(ev.Data), &job)
+			clearProgress()
+			fmt.Printf("%s\n", job)
+		case scan.StreamProgress:
+			p := scan.Progress{}
+			json.Unmarshal([]byte(ev.Data), &p)
+			clearProgress()
+			progress = p.String()
+			fmt.Print(progress)
+		case scan.StreamResult:
+			r := scan.Result{}
+			json.Unmarshal([]byte(ev.Data), &r)
+			clearProgress()
+			fmt.Printf("%s", scan.Results{r})
+		}
+		return ev.Event != scan.StreamDone
+	})
+	if err != nil {
+		fmt.Printf("ERROR: reading events of scan: %s, error: %+v\n", id, err)
+	}
 }
 
 // runCLI runs the CLI. Call this in a forever loop.
 func runCLI(ior io.Reader) {
 	reader := bufio.NewReader(ior)
-	fmt.Printf(prompt)
+	fmt.Print(prompt)
 	input, err := reader.ReadString('\n')
 	if err != nil {
 		fmt.Printf("ERROR: getting user input, error: %+v\n", err)
@@ -164,20 +346,138 @@ func runCLI(ior io.Reader) {
 		args = inputs[1:]
 	}
 	switch cmd {
+	case "cancel", "pause", "resume":
+		if serviceurl == "" {
+			fmt.Printf("%s is only available when using the service; standalone scans run within any budget set.\n", cmd)
+		} else if pendingResultID == "" {
+			fmt.Println(scan.ShowNoScan)
+		} else {
+			getToService(cmd, fmt.Sprintf("%s=%s", cmd, pendingResultID))
+		}
+	case "diff":
+		switch {
+		case serviceurl == "" && len(args) != 0:
+			fmt.Println("diff with IDs is only available when using the service.")
+		case serviceurl == "" && len(previousResults) == 0:
+			fmt.Println("diff requires two scans of the same IPs and port to have been executed.")
+		case serviceurl == "":
+			fmt.Printf("%s", scan.Diff(previousResults, results))
+		case len(args) == 1:
+			getDiffFromService(fmt.Sprintf("/v2/schedules/%s/diff", args[0]))
+		case len(args) == 2:
+			getDiffFromService(fmt.Sprintf("/v2/scans/%s/diff?from=%s", args[1], args[0]))
+		case len(args) > 2:
+			fmt.Println("diff takes no IDs, a schedule ID, or a from and to scan ID.")
+		case previousResultID == "":
+			fmt.Println("diff requires two scans to have been executed.")
+		default:
+			getDiffFromService(fmt.Sprintf("/v2/scans/%s/diff?from=%s", pendingResultID, previousResultID))
+		}
 	case "execute":
 		if serviceurl != "" {
-			getToService(fmt.Sprintf("setips=%s&setport=%s", strings.Join(ips, ","), port))
+			qs := fmt.Sprintf("setips=%s&setport=%s&setprofile=%s", strings.Join(ips, ","), port, profile)
+			if rdns {
+				qs += "&setrdns=on"
+			}
+			if priority != "" {
+				qs += fmt.Sprintf("&setpriority=%s", priority)
+			}
+			if budget > 0 {
+				qs += fmt.Sprintf("&setbudget=%s", budget)
+			}
+			for _, k := range []string{"setthreads", "settimeout", "setretries", "setrate"} {
+				if v, ok := overrides[k]; ok {
+					qs += fmt.Sprintf("&%s=%s", k, v)
+				}
+			}
+			getToService(cmd, qs)
 		} else {
 			execute(port, ips)
 		}
 	case "exit", "quit":
 		os.Exit(0)
 	case "results":
-		if serviceurl != "" {
-			getToService(fmt.Sprintf("results=%s", pendingResultID))
-		} else {
+		summary := len(args) == 1 && args[0] == "--summary"
+		switch {
+		case len(args) != 0 && !summary:
+			fmt.Println("results takes no arguments, or --summary.")
+		case serviceurl != "" && summary:
+			getToService("summary", fmt.Sprintf("summary=%s", pendingResultID))
+		case serviceurl != "":
+			getToService(cmd, fmt.Sprintf("results=%s", pendingResultID))
+		case summary:
+			fmt.Printf("%s", scan.Summarize(results, started, finished))
+		default:
 			fmt.Printf("%s", results)
 		}
+	case "setprofile":
+		if len(args) == 0 {
+			fmt.Printf("Current profile: %s, settings: %s\n", profile, settings)
+			return
+		}
+		s, err := scan.ValidateProfile(profiles, args[0])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			return
+		}
+		profile, settings, overrides = args[0], s, map[string]string{}
+	case "setpriority":
+		if len(args) != 1 {
+			fmt.Printf("%s\n", scan.InvalidPriority)
+			return
+		}
+		p, err := scan.ValidatePriority(args[0])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			return
+		}
+		priority = p
+	case "setrdns":
+		if len(args) != 1 {
+			fmt.Printf("%s\n", scan.InvalidRDNS)
+			return
+		}
+		rdns, err = scan.ValidateRDNS(args[0])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+		}
+	case "setthreads", "settimeout", "setretries", "setrate":
+		if len(args) != 1 {
+			fmt.Printf("%s requires a single value.\n", cmd)
+			return
+		}
+		s, err := settings.Override(strings.TrimPrefix(cmd, "set"), args[0])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			return
+		}
+		settings = s
+		overrides[cmd] = args[0]
+	case "status":
+		if serviceurl == "" {
+			fmt.Println("status is only available when using the service; execute shows progress while it runs.")
+		} else if pendingResultID == "" {
+			fmt.Println(scan.ShowNoScan)
+		} else {
+			getToService(cmd, fmt.Sprintf("status=%s", pendingResultID))
+		}
+	case "watch":
+		if serviceurl == "" {
+			fmt.Println("watch is only available when using the service; execute shows progress while it runs.")
+		} else if pendingResultID == "" {
+			fmt.Println(scan.ShowNoScan)
+		} else {
+			watchService(pendingResultID)
+		}
+	case "setbudget":
+		if len(args) != 1 {
+			fmt.Printf("%s\n", scan.InvalidBudget)
+			return
+		}
+		budget, err = scan.ValidateBudget(args[0])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+		}
 	case "setips":
 		results = scan.Results{}
 		ips, err = scan.ValidateIPs(args, true)
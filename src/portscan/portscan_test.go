@@ -8,7 +8,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/paulfdunn/portscan/src/scan"
@@ -57,3 +63,136 @@ func TestExecute(t *testing.T) {
 	}
 	fmt.Println("TestExecute done")
 }
+
+// newTestService returns a server standing in for portscanservice: execute returns the next scan
+// ID, status, cancel, pause and resume return the job with the ID in the query, summary returns a
+// summary of that job, and diff returns an empty diff of the scans in the request.
+func newTestService() *httptest.Server {
+	scans := 0
+	states := map[string]string{"status": scan.JobRunning, "cancel": scan.JobCancelled,
+		"pause": scan.JobPaused, "resume": scan.JobRunning}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set(scan.ServiceHeader, scan.ServiceAppName)
+		var out interface{}
+		status := http.StatusOK
+		if strings.HasPrefix(r.URL.Path, "/v2/scans/") {
+			to := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/scans/"), "/diff")
+			out = scan.ResultsDiff{From: q.Get("from"), To: to}
+		}
+		if id := q.Get("summary"); id != "" {
+			out = scan.Summary{ID: id, Results: 2, Hosts: 1, States: map[string]int{scan.StateOpen: 1}}
+		}
+		if _, ok := q["setips"]; ok {
+			scans++
+			out, status = scan.ID{ID: fmt.Sprintf("scan%d", scans)}, http.StatusAccepted
+		}
+		for action, state := range states {
+			if id := q.Get(action); id != "" {
+				out = scan.Job{ID: id, State: state}
+			}
+		}
+		// As the service, cancel is accepted as the job may not be cancelled yet.
+		if q.Get("cancel") != "" {
+			status = http.StatusAccepted
+		}
+		if out == nil {
+			http.Error(w, "ERROR: unknown request", http.StatusBadRequest)
+			return
+		}
+		b, _ := json.Marshal(out)
+		w.WriteHeader(status)
+		w.Write(b)
+	}))
+}
+
+// useService points the CLI at ts with no scans executed; call the returned func to stop using it.
+func useService(ts *httptest.Server) func() {
+	serviceurl, previousResultID, pendingResultID = ts.URL+"/", "", ""
+	return func() { serviceurl, previousResultID, pendingResultID = "", "", "" }
+}
+
+// cliOutput feeds each input line to the CLI, and returns what it prints.
+func cliOutput(inputs ...string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- string(b)
+	}()
+	for _, input := range inputs {
+		runCLI(bytes.NewBufferString(input + "\n"))
+	}
+	os.Stdout = stdout
+	w.Close()
+	return <-out
+}
+
+// TestServiceStatus validates that status prints the pending scan, which it does not change.
+func TestServiceStatus(t *testing.T) {
+	ts := newTestService()
+	defer ts.Close()
+	defer useService(ts)()
+
+	out := cliOutput("execute", "status")
+	if !strings.Contains(out, "ID: scan1, State: "+scan.JobRunning+",") || pendingResultID != "scan1" {
+		t.Errorf("Unexpected status, pending: %s, output: %s", pendingResultID, out)
+	}
+}
+
+// TestServiceCancel validates that cancel prints the cancelled scan, and does not change the pending
+// scan.
+func TestServiceCancel(t *testing.T) {
+	ts := newTestService()
+	defer ts.Close()
+	defer useService(ts)()
+
+	out := cliOutput("execute", "cancel")
+	if !strings.Contains(out, "ID: scan1, State: "+scan.JobCancelled+",") || pendingResultID != "scan1" {
+		t.Errorf("Unexpected cancel, pending: %s, output: %s", pendingResultID, out)
+	}
+}
+
+// TestServicePause validates that pause and resume print the scan, and do not change the pending
+// scan.
+func TestServicePause(t *testing.T) {
+	ts := newTestService()
+	defer ts.Close()
+	defer useService(ts)()
+
+	out := cliOutput("execute", "pause", "resume")
+	if !strings.Contains(out, "ID: scan1, State: "+scan.JobPaused+",") ||
+		!strings.Contains(out, "ID: scan1, State: "+scan.JobRunning+",") || pendingResultID != "scan1" {
+		t.Errorf("Unexpected pause and resume, pending: %s, output: %s", pendingResultID, out)
+	}
+}
+
+// TestServiceDiff validates that diff compares the last two scans executed, whatever other commands
+// were used since.
+func TestServiceDiff(t *testing.T) {
+	ts := newTestService()
+	defer ts.Close()
+	defer useService(ts)()
+
+	out := cliOutput("execute", "execute", "status", "cancel", "pause", "resume", "results --summary", "diff")
+	if !strings.Contains(out, "From: scan1, To: scan2") || previousResultID != "scan1" || pendingResultID != "scan2" {
+		t.Errorf("Unexpected diff, previous: %s, pending: %s, output: %s", previousResultID, pendingResultID, out)
+	}
+}
+
+// TestServiceSummary validates that results --summary prints the summary of the pending scan.
+func TestServiceSummary(t *testing.T) {
+	ts := newTestService()
+	defer ts.Close()
+	defer useService(ts)()
+
+	out := cliOutput("execute", "results --summary")
+	if !strings.Contains(out, "ID: scan1\nResults: 2, Hosts: 1, Open: 1,") || pendingResultID != "scan1" {
+		t.Errorf("Unexpected summary, pending: %s, output: %s", pendingResultID, out)
+	}
+}
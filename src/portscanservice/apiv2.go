@@ -0,0 +1,312 @@
+package main
+
+// apiv2.go implements the v2 API, a ReSTful interface using JSON request and response bodies:
+// POST /v2/scans          start a scan; the body is a scan.Request, returns 202 and the scan.ID,
+//                         or 429 if the service is at capacity.
+// GET /v2/scans           list scans, as scan.Job without results.
+// GET /v2/scans/{id}      get a scan.Job with results; results are partial until the scan is done.
+//                         A queued scan.Job includes its position in the queue.
+// DELETE /v2/scans/{id}   delete a scan that is done, and its results.
+// GET /v2/scans/{id}/results
+//                         get the scan.Results of a scan, partial until the scan is done; with
+//                         format=ndjson, one scan.Result per line, written incrementally. Results
+//                         may be filtered, sorted and paged; see filter.go.
+// GET /v2/scans/{id}/summary
+//                         get the scan.Summary of the results of a scan; partial until the scan is
+//                         done.
+// POST /v2/scans/{id}/cancel
+//                         cancel a scan that is not done, keeping the results collected so far;
+//                         returns 202 and the scan.Job.
+// POST /v2/scans/{id}/pause
+// POST /v2/scans/{id}/resume
+//                         pause a queued or running scan, or resume a paused scan; returns 200 and
+//                         the scan.Job.
+// GET /v2/scans/{id}/diff?from={id}
+//                         get the scan.ResultsDiff of the ports that opened, closed or changed state
+//                         from the results of the from scan to the results of this scan; both scans
+//                         must be done.
+// GET /v2/scans/{id}/events
+//                         stream the state, progress and results of a scan as Server-Sent Events;
+//                         see events.go.
+// Errors are returned with the appropriate status code and a scan.APIError body.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+const (
+	v2ScansPath = "/v2/scans"
+	// v2Diff is the path segment, following a scan or schedule ID, of diffs.
+	v2Diff = "diff"
+	// v2Results is the path segment, following a scan ID, of results.
+	v2Results = "results"
+
+	// maxRequestBytes limits the size of request bodies.
+	maxRequestBytes = 1 << 20
+)
+
+// handlerV2Scans handles all requests to v2ScansPath.
+func handlerV2Scans(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("ERROR: %+v\n%s", err, string(debug.Stack()))
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("%+v", err))
+			return
+		}
+	}()
+
+	// Always let callers know the responding app.
+	w.Header().Set(scan.ServiceHeader, scan.ServiceAppName)
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, v2ScansPath), "/"), "/")
+	id := path[0]
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			v2ListScans(w, r)
+		case http.MethodPost:
+			v2CreateScan(w, r)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	if action, ok := jobActions[path[len(path)-1]]; ok && len(path) == 2 {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		v2JobAction(w, r, id, path[1], action)
+		return
+	}
+	if len(path) == 2 && path[1] == v2Events {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		v2ScanEvents(w, r, id)
+		return
+	}
+	if len(path) == 2 && path[1] == v2Diff {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		v2DiffScans(w, r, id)
+		return
+	}
+	if len(path) == 2 && path[1] == v2Summary {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		v2GetSummary(w, r, id)
+		return
+	}
+	if len(path) == 2 && path[1] == v2Results {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		v2GetResults(w, r, id)
+		return
+	}
+	if len(path) != 1 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s was not found", r.URL.Path))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		v2GetScan(w, r, id)
+	case http.MethodDelete:
+		v2DeleteScan(w, r, id)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// v2CreateScan validates the scan.Request in the body and starts the scan.
+func v2CreateScan(w http.ResponseWriter, r *http.Request) {
+	sr := scan.Request{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sr); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parsing request body, error: %+v", err))
+		return
+	}
+
+	req, status, err := validateScanRequest(sr, r.RemoteAddr)
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+
+	id, err := startScan(req)
+	if err == errQueueFull {
+		writeJSONError(w, http.StatusTooManyRequests, err)
+		return
+	} else if err == errShuttingDown {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", v2ScansPath+"/"+id)
+	writeJSON(w, http.StatusAccepted, scan.ID{ID: id})
+}
+
+// v2ListScans writes all scans, oldest first, without results.
+func v2ListScans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jobs.list())
+}
+
+// v2GetScan writes the scan with the specified ID.
+func v2GetScan(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot(true))
+}
+
+// v2GetResults writes the results of the scan with the specified ID, in the format given by the
+// format query key. Partial results have the partial headers set.
+func v2GetResults(w http.ResponseWriter, r *http.Request, id string) {
+	format, err := validateFormat(r.URL.Query().Get(cmdFormat))
+	var q resultsQuery
+	if err == nil {
+		q, err = parseResultsQuery(r.URL.Query())
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	sj := j.snapshot(true)
+	if sj.Partial {
+		w.Header().Set(scan.PartialHeader, "true")
+		w.Header().Set(scan.PercentHeader, fmt.Sprintf("%.1f", sj.Percent))
+	}
+	results, next := q.apply(sj.Results)
+	if next != "" {
+		w.Header().Set(scan.CursorHeader, next)
+	}
+	if format == formatNDJSON {
+		writeNDJSON(w, http.StatusOK, results)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// v2DiffScans writes the diff from the scan given by the from query key to the scan with the
+// specified ID.
+func v2DiffScans(w http.ResponseWriter, r *http.Request, id string) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("the from query key, the ID of the scan to compare to, is required"))
+		return
+	}
+	d, status, err := diffJobs(from, id)
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// diffJobs returns the diff from the results of the job with the ID from to the results of the job
+// with the ID to. If either job is unknown or not done, the status and error to return are
+// returned.
+func diffJobs(from string, to string) (scan.ResultsDiff, int, error) {
+	results := make([]scan.Results, 2)
+	for i, id := range []string{from, to} {
+		j, ok := jobs.get(id)
+		if !ok {
+			return scan.ResultsDiff{}, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id)
+		}
+		sj := j.snapshot(true)
+		if !sj.Done() {
+			return scan.ResultsDiff{}, http.StatusConflict, fmt.Errorf("ID %s is %s", id, sj.State)
+		}
+		results[i] = sj.Results
+	}
+	d := scan.Diff(results[0], results[1])
+	d.From, d.To = from, to
+	return d, http.StatusOK, nil
+}
+
+// v2DeleteScan deletes the scan with the specified ID, once it is done.
+func v2DeleteScan(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	if sj := j.snapshot(false); !sj.Done() {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("ID %s is %s", id, sj.State))
+		return
+	}
+
+	jobs.delete(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// v2JobAction applies action, one of jobActions, named name, to the scan with the specified ID.
+func v2JobAction(w http.ResponseWriter, r *http.Request, id string, name string, action func(*job) bool) {
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	if !action(j) {
+		writeJSONError(w, http.StatusConflict,
+			fmt.Errorf("ID %s is %s, and cannot be %s", id, j.snapshot(false).State, jobActionStates[name]))
+		return
+	}
+	// Cancel completes once probes in flight complete; pause and resume are immediate.
+	status := http.StatusOK
+	if name == cmdCancel {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, j.snapshot(false))
+}
+
+// writeJSON writes v as JSON with the specified status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeJSONError writes err as a scan.APIError with the specified status.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	fmt.Printf("ERROR: %+v\n", err)
+	b, _ := json.Marshal(scan.APIError{Error: fmt.Sprintf("%+v", err)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeMethodNotAllowed writes a 405 error listing the allowed methods.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed for %s", r.Method, r.URL.Path))
+}
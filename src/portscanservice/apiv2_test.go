@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+type v2Test struct {
+	method string
+	path   string
+	body   string
+	status int
+}
+
+// doV2 makes a request and returns the status and body.
+func doV2(t *testing.T, ts *httptest.Server, method string, path string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %+v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error from %s %s, error: %+v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// TestV2Errors validates status codes and JSON error bodies for bad requests.
+func TestV2Errors(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+	tests := []v2Test{
+		{http.MethodPost, v2ScansPath, `{"IPs":["8.8.8.8"],"Port":"65536"}`, http.StatusBadRequest},
+		{http.MethodPost, v2ScansPath, `{"IPs":["1.2.3.4.5"],"Port":"443"}`, http.StatusBadRequest},
+		{http.MethodPost, v2ScansPath, `{"IPs":["8.8.8.8"],"Port":"443","Color":"blue"}`, http.StatusBadRequest},
+		{http.MethodPost, v2ScansPath, `not json`, http.StatusBadRequest},
+		{http.MethodPost, v2ScansPath, `{"IPs":["127.0.0.1"],"Port":"443"}`, http.StatusForbidden},
+		{http.MethodPut, v2ScansPath, ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, v2ScansPath + "/not_an_id", ``, http.StatusNotFound},
+		{http.MethodDelete, v2ScansPath + "/not_an_id", ``, http.StatusNotFound},
+		{http.MethodGet, v2ScansPath + "/not_an_id/extra", ``, http.StatusNotFound},
+		{http.MethodPost, v2ScansPath + "/not_an_id/" + cmdCancel, ``, http.StatusNotFound},
+		{http.MethodGet, v2ScansPath + "/not_an_id/" + cmdCancel, ``, http.StatusMethodNotAllowed},
+	}
+	for _, v := range tests {
+		status, body := doV2(t, ts, v.method, v.path, v.body)
+		apiErr := scan.APIError{}
+		if status != v.status || json.Unmarshal(body, &apiErr) != nil || apiErr.Error == "" {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+}
+
+// TestV2Lifecycle creates, gets, lists and deletes a scan.
+func TestV2Lifecycle(t *testing.T) {
+	*timeout = time.Duration(100) * time.Millisecond
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { policy = defaultPolicy }()
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	status, body := doV2(t, ts, http.MethodPost, v2ScansPath, `{"IPs":["127.0.0.1"],"Port":"4430"}`)
+	id := scan.ID{}
+	if status != http.StatusAccepted || json.Unmarshal(body, &id) != nil || id.ID == "" {
+		t.Fatalf("Unexpected response creating scan, status: %d, body: %s", status, body)
+	}
+
+	time.Sleep(*timeout)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	status, body = doV2(t, ts, http.MethodGet, v2ScansPath+"/"+id.ID, "")
+	job := scan.Job{}
+	if status != http.StatusOK || json.Unmarshal(body, &job) != nil || job.State != scan.JobCompleted || len(job.Results) != 1 {
+		t.Errorf("Unexpected response getting scan, status: %d, body: %s", status, body)
+	}
+
+	status, body = doV2(t, ts, http.MethodGet, v2ScansPath, "")
+	jobs := []scan.Job{}
+	found := false
+	json.Unmarshal(body, &jobs)
+	for _, j := range jobs {
+		found = found || (j.ID == id.ID && j.Results == nil)
+	}
+	if status != http.StatusOK || !found {
+		t.Errorf("Unexpected response listing scans, status: %d, body: %s", status, body)
+	}
+
+	if status, body = doV2(t, ts, http.MethodDelete, v2ScansPath+"/"+id.ID, ""); status != http.StatusNoContent {
+		t.Errorf("Unexpected response deleting scan, status: %d, body: %s", status, body)
+	}
+	if status, body = doV2(t, ts, http.MethodGet, v2ScansPath+"/"+id.ID, ""); status != http.StatusNotFound {
+		t.Errorf("Unexpected response getting deleted scan, status: %d, body: %s", status, body)
+	}
+}
+
+// TestV2Diff validates diffs of scans, and of the last two completed runs of a schedule.
+func TestV2Diff(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	open, refused := scan.NoError, "connect: connection refused"
+	from := doneJob(jobs, scan.Results{{IP: "10.0.0.1", Port: "443", Error: &refused}}, 0)
+	to := doneJob(jobs, scan.Results{{IP: "10.0.0.1", Port: "443", Error: &open}}, 0)
+	queued, err := newJob(scanRequest{ips: []string{"10.0.0.1"}, port: "443"})
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	s, err := newSchedule(scan.ScheduleRequest{Interval: "1h"}, scanRequest{}, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	schedules.add(s)
+	defer schedules.delete(s.id)
+
+	diffPath := v2ScansPath + "/" + to.id + "/" + v2Diff
+	tests := []v2Test{
+		{http.MethodGet, diffPath, ``, http.StatusBadRequest},
+		{http.MethodGet, diffPath + "?from=not_an_id", ``, http.StatusNotFound},
+		{http.MethodGet, diffPath + "?from=" + queued.id, ``, http.StatusConflict},
+		{http.MethodPost, diffPath + "?from=" + from.id, ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, v2SchedulesPath + "/" + s.id + "/" + v2Diff, ``, http.StatusConflict},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+
+	status, body := doV2(t, ts, http.MethodGet, diffPath+"?from="+from.id, "")
+	d := scan.ResultsDiff{}
+	if status != http.StatusOK || json.Unmarshal(body, &d) != nil || d.From != from.id || d.To != to.id ||
+		d.Opened != 1 || len(d.Hosts) != 1 {
+		t.Errorf("Unexpected response getting a diff, status: %d, body: %s", status, body)
+	}
+
+	// The runs of a schedule are compared oldest to newest.
+	from.req.scheduleID, to.req.scheduleID = s.id, s.id
+	status, body = doV2(t, ts, http.MethodGet, v2SchedulesPath+"/"+s.id+"/"+v2Diff, "")
+	d = scan.ResultsDiff{}
+	if status != http.StatusOK || json.Unmarshal(body, &d) != nil || d.From != from.id || d.To != to.id {
+		t.Errorf("Unexpected response getting a schedule diff, status: %d, body: %s", status, body)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+// apiv2schedules.go implements the schedules resource of the v2 API:
+// POST /v2/schedules      create a schedule; the body is a scan.ScheduleRequest, returns 201 and the
+//                         scan.Schedule.
+// GET /v2/schedules       list schedules, as scan.Schedule without the IDs of runs.
+// GET /v2/schedules/{id}  get a scan.Schedule, with the IDs of runs; get each run from /v2/scans.
+// DELETE /v2/schedules/{id}
+//                         delete a schedule; its runs are kept.
+// POST /v2/schedules/{id}/pause
+// POST /v2/schedules/{id}/resume
+//                         pause or resume a schedule; returns 200 and the scan.Schedule.
+// GET /v2/schedules/{id}/diff
+//                         get the scan.ResultsDiff between the last two completed runs; returns 409
+//                         if there are fewer than two.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+const v2SchedulesPath = "/v2/schedules"
+
+// scheduleActions are the v2 API actions that change the state of a schedule. Each returns false
+// if the state of the schedule does not allow the action.
+var scheduleActions = map[string]func(*schedule) bool{
+	cmdPause:  (*schedule).pause,
+	cmdResume: (*schedule).unpause,
+}
+
+// handlerV2Schedules handles all requests to v2SchedulesPath.
+func handlerV2Schedules(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("ERROR: %+v\n%s", err, string(debug.Stack()))
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("%+v", err))
+			return
+		}
+	}()
+
+	// Always let callers know the responding app.
+	w.Header().Set(scan.ServiceHeader, scan.ServiceAppName)
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, v2SchedulesPath), "/"), "/")
+	id := path[0]
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, schedules.list())
+		case http.MethodPost:
+			v2CreateSchedule(w, r)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	if action, ok := scheduleActions[path[len(path)-1]]; ok && len(path) == 2 {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		v2ScheduleAction(w, r, id, path[1], action)
+		return
+	}
+	if len(path) == 2 && path[1] == v2Diff {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		v2DiffSchedule(w, r, id)
+		return
+	}
+	if len(path) != 1 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s was not found", r.URL.Path))
+		return
+	}
+	s, ok := schedules.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized schedule ID", id))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.snapshot(true))
+	case http.MethodDelete:
+		schedules.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// v2CreateSchedule validates the scan.ScheduleRequest in the body and adds the schedule.
+func v2CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	sr := scan.ScheduleRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sr); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parsing request body, error: %+v", err))
+		return
+	}
+
+	req, status, err := validateScanRequest(sr.Scan, r.RemoteAddr)
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	s, err := newSchedule(sr, req, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := schedules.add(s); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("INFO: created schedule %s, next run: %s\n", s.id, s.nextRun)
+	w.Header().Set("Location", v2SchedulesPath+"/"+s.id)
+	writeJSON(w, http.StatusCreated, s.snapshot(false))
+}
+
+// v2DiffSchedule writes the diff between the last two completed runs of the schedule with the
+// specified ID.
+func v2DiffSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	s, ok := schedules.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized schedule ID", id))
+		return
+	}
+	runs := s.completedRuns()
+	if len(runs) < 2 {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("schedule %s has %d completed runs; 2 are required", id, len(runs)))
+		return
+	}
+	d, status, err := diffJobs(runs[len(runs)-2], runs[len(runs)-1])
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// v2ScheduleAction applies action, one of scheduleActions, named name, to the schedule with the
+// specified ID.
+func v2ScheduleAction(w http.ResponseWriter, r *http.Request, id string, name string, action func(*schedule) bool) {
+	s, ok := schedules.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized schedule ID", id))
+		return
+	}
+	if !action(s) {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("schedule %s is already %s", id, jobActionStates[name]))
+		return
+	}
+	schedules.save(s)
+	writeJSON(w, http.StatusOK, s.snapshot(false))
+}
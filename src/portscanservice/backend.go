@@ -0,0 +1,283 @@
+package main
+
+// backend.go persists jobs, with their requests and results, and schedules, so they survive a
+// service restart. The jobStore and scheduleStore keep everything in memory, and write each change
+// through to a jobBackend; on startup they are restored from the backend.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// jobBackend stores jobRecords and scheduleRecords by ID.
+type jobBackend interface {
+	// save adds or replaces the record with the ID rec.Job.ID.
+	save(rec jobRecord) error
+	// remove removes the record with the specified ID; removing an unknown ID is not an error.
+	remove(id string) error
+	// load returns all records.
+	load() ([]jobRecord, error)
+
+	// saveSchedule, removeSchedule and loadSchedules are the same, for schedules.
+	saveSchedule(rec scheduleRecord) error
+	removeSchedule(id string) error
+	loadSchedules() ([]scheduleRecord, error)
+}
+
+// jobRecord is the persisted form of a job.
+type jobRecord struct {
+	Job     scan.Job
+	Request requestRecord
+}
+
+// requestRecord is the persisted form of a scanRequest.
+type requestRecord struct {
+	IPs        []string
+	Port       string
+	Budget     time.Duration
+	Settings   scan.Settings
+	RDNS       bool
+	TTL        time.Duration
+	Priority   string
+	Submitter  string
+	ScheduleID string `json:",omitempty"`
+	Webhook    string `json:",omitempty"`
+}
+
+// newRequestRecord returns the requestRecord for r.
+func newRequestRecord(r scanRequest) requestRecord {
+	return requestRecord{IPs: r.ips, Port: r.port, Budget: r.budget, Settings: r.settings, RDNS: r.rdns,
+		TTL: r.ttl, Priority: r.priority, Submitter: r.submitter, ScheduleID: r.scheduleID, Webhook: r.webhook}
+}
+
+// scanRequest returns the scanRequest for r.
+func (r requestRecord) scanRequest() scanRequest {
+	return scanRequest{ips: r.IPs, port: r.Port, budget: r.Budget, settings: r.Settings, rdns: r.RDNS,
+		ttl: r.TTL, priority: r.Priority, submitter: r.Submitter, scheduleID: r.ScheduleID, webhook: r.Webhook}
+}
+
+// record returns the jobRecord for j.
+func (j *job) record() jobRecord {
+	return jobRecord{Job: j.snapshot(true), Request: newRequestRecord(j.req)}
+}
+
+// jobFromRecord returns the job for rec.
+func jobFromRecord(rec jobRecord) *job {
+	sj := rec.Job
+	j := &job{id: sj.ID, req: rec.Request.scanRequest(), state: sj.State, created: sj.Created,
+		started: sj.Started, finished: sj.Finished, progress: sj.Progress, results: sj.Results, err: sj.Error,
+		expires: sj.Expires}
+	if j.results == nil {
+		j.results = scan.Results{}
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	return j
+}
+
+// nopBackend discards records; it is used without the storedir flag, as the jobStore and
+// scheduleStore already keep everything in memory. Jobs and schedules do not survive a restart.
+type nopBackend struct{}
+
+func (nopBackend) save(rec jobRecord) error                 { return nil }
+func (nopBackend) remove(id string) error                   { return nil }
+func (nopBackend) load() ([]jobRecord, error)               { return nil, nil }
+func (nopBackend) saveSchedule(rec scheduleRecord) error    { return nil }
+func (nopBackend) removeSchedule(id string) error           { return nil }
+func (nopBackend) loadSchedules() ([]scheduleRecord, error) { return nil, nil }
+
+// memoryBackend keeps records in memory, I.E. for tests; jobs and schedules do not survive a
+// restart.
+type memoryBackend struct {
+	mu        sync.Mutex
+	records   map[string]jobRecord
+	schedules map[string]scheduleRecord
+}
+
+// newMemoryBackend returns an empty memoryBackend.
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{records: make(map[string]jobRecord), schedules: make(map[string]scheduleRecord)}
+}
+
+func (mb *memoryBackend) save(rec jobRecord) error {
+	mb.mu.Lock()
+	mb.records[rec.Job.ID] = rec
+	mb.mu.Unlock()
+	return nil
+}
+
+func (mb *memoryBackend) remove(id string) error {
+	mb.mu.Lock()
+	delete(mb.records, id)
+	mb.mu.Unlock()
+	return nil
+}
+
+func (mb *memoryBackend) load() ([]jobRecord, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	out := make([]jobRecord, 0, len(mb.records))
+	for _, rec := range mb.records {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+func (mb *memoryBackend) saveSchedule(rec scheduleRecord) error {
+	mb.mu.Lock()
+	mb.schedules[rec.Schedule.ID] = rec
+	mb.mu.Unlock()
+	return nil
+}
+
+func (mb *memoryBackend) removeSchedule(id string) error {
+	mb.mu.Lock()
+	delete(mb.schedules, id)
+	mb.mu.Unlock()
+	return nil
+}
+
+func (mb *memoryBackend) loadSchedules() ([]scheduleRecord, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	out := make([]scheduleRecord, 0, len(mb.schedules))
+	for _, rec := range mb.schedules {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// fileBackend keeps each record as a JSON file, named by ID, in a directory; schedules are kept in
+// the schedulesDir subdirectory.
+type fileBackend struct {
+	dir string
+}
+
+const (
+	// recordExt is the file extension of records written by fileBackend.
+	recordExt = ".json"
+	// schedulesDir is the subdirectory of schedule records.
+	schedulesDir = "schedules"
+)
+
+// newFileBackend returns a fileBackend using dir, creating dir if it does not exist.
+func newFileBackend(dir string) (*fileBackend, error) {
+	if err := os.MkdirAll(filepath.Join(dir, schedulesDir), 0700); err != nil {
+		return nil, fmt.Errorf("creating store directory %s, error: %+v", dir, err)
+	}
+	return &fileBackend{dir: dir}, nil
+}
+
+// path returns the path of the record with the specified ID in dir.
+func (fb *fileBackend) path(dir string, id string) string {
+	return filepath.Join(dir, filepath.Base(id)+recordExt)
+}
+
+func (fb *fileBackend) save(rec jobRecord) error {
+	return writeRecord(fb.path(fb.dir, rec.Job.ID), rec)
+}
+
+func (fb *fileBackend) remove(id string) error {
+	return removeRecord(fb.path(fb.dir, id))
+}
+
+func (fb *fileBackend) load() ([]jobRecord, error) {
+	out := []jobRecord{}
+	err := readRecords(fb.dir, func(b []byte) error {
+		rec := jobRecord{}
+		err := json.Unmarshal(b, &rec)
+		if err == nil {
+			out = append(out, rec)
+		}
+		return err
+	})
+	return out, err
+}
+
+func (fb *fileBackend) saveSchedule(rec scheduleRecord) error {
+	return writeRecord(fb.path(filepath.Join(fb.dir, schedulesDir), rec.Schedule.ID), rec)
+}
+
+func (fb *fileBackend) removeSchedule(id string) error {
+	return removeRecord(fb.path(filepath.Join(fb.dir, schedulesDir), id))
+}
+
+func (fb *fileBackend) loadSchedules() ([]scheduleRecord, error) {
+	out := []scheduleRecord{}
+	err := readRecords(filepath.Join(fb.dir, schedulesDir), func(b []byte) error {
+		rec := scheduleRecord{}
+		err := json.Unmarshal(b, &rec)
+		if err == nil {
+			out = append(out, rec)
+		}
+		return err
+	})
+	return out, err
+}
+
+// writeRecord writes v as JSON to a temporary file, then renames it to path, so a record is never
+// partially written. Each write uses its own temporary file.
+func writeRecord(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating record %s, error: %+v", path, err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing record %s, error: %+v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeRecord removes the record at path; a record that does not exist is not an error.
+func removeRecord(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readRecords calls parse with the contents of each record in dir; records that cannot be read
+// or parsed are logged and skipped.
+func readRecords(dir string, parse func([]byte) error) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading store directory %s, error: %+v", dir, err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), recordExt) {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("ERROR: reading record %s, error: %+v\n", path, err)
+			continue
+		}
+		if err := parse(b); err != nil {
+			fmt.Printf("ERROR: parsing record %s, error: %+v\n", path, err)
+		}
+	}
+	return nil
+}
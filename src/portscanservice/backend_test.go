@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestFileBackend validates saving, loading and removing records.
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portscanservice")
+	if err != nil {
+		t.Fatalf("Error creating directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	fb, err := newFileBackend(dir)
+	if err != nil {
+		t.Fatalf("Error creating backend: %+v", err)
+	}
+
+	refused := "connection refused"
+	j := &job{id: "some-id", req: scanRequest{ips: []string{"127.0.0.1"}, port: "443", budget: time.Minute,
+		settings: scan.Settings{Threads: 2, Timeout: time.Second}, priority: scan.PriorityBatch},
+		state: scan.JobCompleted, created: time.Now(), finished: time.Now(),
+		results: scan.Results{{IP: "127.0.0.1", Port: "443", Error: &refused}}}
+	if err := fb.save(j.record()); err != nil {
+		t.Fatalf("Error saving record: %+v", err)
+	}
+	ioutil.WriteFile(dir+"/not-a-record.json", []byte("not json"), 0600)
+
+	recs, err := fb.load()
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("Unexpected records: %+v, error: %+v", recs, err)
+	}
+	lj := jobFromRecord(recs[0])
+	if lj.id != j.id || lj.state != j.state || lj.req.budget != j.req.budget || lj.req.settings != j.req.settings ||
+		lj.req.priority != j.req.priority || len(lj.results) != 1 || *lj.results[0].Error != refused {
+		t.Errorf("Unexpected job from record: %+v", lj)
+	}
+
+	if err := fb.remove(j.id); err != nil {
+		t.Errorf("Error removing record: %+v", err)
+	}
+	if err := fb.remove(j.id); err != nil {
+		t.Errorf("Error removing a record that does not exist: %+v", err)
+	}
+	if recs, _ := fb.load(); len(recs) != 0 {
+		t.Errorf("Unexpected records after remove: %+v", recs)
+	}
+}
+
+// TestFileBackendConcurrentSaves validates that concurrent saves of a job leave its latest record,
+// and no temporary files.
+func TestFileBackendConcurrentSaves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portscanservice")
+	if err != nil {
+		t.Fatalf("Error creating directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	fb, err := newFileBackend(dir)
+	if err != nil {
+		t.Fatalf("Error creating backend: %+v", err)
+	}
+	js := newJobStore(1<<20, time.Hour, fb)
+	j := &job{id: "some-id", state: scan.JobRunning, created: time.Now(), progress: scan.Progress{Total: 100}}
+	js.add(j)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(done int) {
+			defer wg.Done()
+			j.mu.Lock()
+			if done > j.progress.Completed {
+				j.progress.Completed = done
+			}
+			j.mu.Unlock()
+			js.save(j)
+		}(i)
+	}
+	wg.Wait()
+
+	recs, err := fb.load()
+	if err != nil || len(recs) != 1 || recs[0].Job.Progress.Completed != 100 {
+		t.Errorf("Unexpected records: %+v, error: %+v", recs, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) != recordExt {
+			t.Errorf("Unexpected file: %s", f.Name())
+		}
+	}
+}
+
+// TestRestore validates that done jobs are restored, and jobs that were not done are returned to
+// be resumed.
+func TestRestore(t *testing.T) {
+	mb := newMemoryBackend()
+	js := newJobStore(1<<20, time.Hour, mb)
+	done := doneJob(js, scan.Results{{IP: "127.0.0.1", Port: "443"}}, 0)
+	expired := doneJob(js, scan.Results{}, time.Millisecond)
+	running := &job{id: "running-id", state: scan.JobRunning, created: time.Now()}
+	js.add(running)
+	time.Sleep(10 * time.Millisecond)
+
+	restored := newJobStore(1<<20, time.Hour, mb)
+	interrupted, err := restored.restore()
+	if err != nil {
+		t.Fatalf("Error restoring: %+v", err)
+	}
+	if j, ok := restored.get(done.id); !ok || len(j.snapshot(true).Results) != 1 {
+		t.Errorf("Done job was not restored")
+	}
+	if _, ok := restored.get(expired.id); ok {
+		t.Errorf("Expired job was restored")
+	}
+	if _, ok := restored.get(running.id); !ok || len(interrupted) != 1 || interrupted[0].id != running.id {
+		t.Errorf("Unexpected interrupted jobs: %+v", interrupted)
+	}
+	if len(mb.records) != 2 {
+		t.Errorf("Unexpected records: %+v", mb.records)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+// config.go configures the service from, in order of precedence (highest first): command line
+// flags, PORTSCAN_* environment variables, a JSON config file, and the flag defaults. Every flag
+// can be given in each; the environment variable is PORTSCAN_ and the flag name in upper case
+// (I.E. PORTSCAN_HTTPPORT), and the config file is a JSON object of flag names to values. Example:
+// {"httpport": "9000", "workers": 200, "resultsttl": "12h", "storedir": "/var/lib/portscan"}
+// The config file is given with the config flag, or PORTSCAN_CONFIG. The dumpconfig flag prints
+// the effective config, in the config file format, and exits.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// configEnvPrefix is the prefix of the environment variable of each flag.
+	configEnvPrefix = "PORTSCAN_"
+	// configFlag and dumpConfigFlag are the names of the flags that are not themselves config.
+	configFlag     = "config"
+	dumpConfigFlag = "dumpconfig"
+	// configRedacted replaces the values of secretFlags in the dumped config.
+	configRedacted = "REDACTED"
+)
+
+// secretFlags are flags whose values are not dumped.
+var secretFlags = map[string]bool{"webhooksecret": true}
+
+// loadConfig sets each flag of fs that was not set on the command line from the environment, using
+// getenv, or else from the config file. Call after fs.Parse.
+func loadConfig(fs *flag.FlagSet, getenv func(string) string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	values := make(map[string]string)
+	path := ""
+	if f := fs.Lookup(configFlag); f != nil {
+		path = f.Value.String()
+		if v := getenv(configEnvName(configFlag)); v != "" && !set[configFlag] {
+			path = v
+		}
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading config file %s, error: %+v", path, err)
+		}
+		file := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(b, &file); err != nil {
+			return fmt.Errorf("parsing config file %s, error: %+v", path, err)
+		}
+		for k, raw := range file {
+			name := strings.ToLower(k)
+			if fs.Lookup(name) == nil || name == configFlag || name == dumpConfigFlag {
+				return fmt.Errorf("config file %s, unknown key: %s", path, k)
+			}
+			v, err := configValue(raw)
+			if err != nil {
+				return fmt.Errorf("config file %s, key %s, error: %+v", path, k, err)
+			}
+			values[name] = v
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag || f.Name == dumpConfigFlag {
+			return
+		}
+		source := "config file " + path
+		v, ok := values[f.Name]
+		if ev := getenv(configEnvName(f.Name)); ev != "" {
+			v, ok, source = ev, true, configEnvName(f.Name)
+		}
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%s, invalid %s: %s, error: %+v", source, f.Name, v, serr)
+		}
+	})
+	return err
+}
+
+// configEnvName returns the name of the environment variable of the named flag.
+func configEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(name)
+}
+
+// configValue returns the value of a config file key as a flag value; strings, numbers and booleans
+// are allowed.
+func configValue(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return fmt.Sprintf("%t", b), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var n json.Number
+	if err := dec.Decode(&n); err == nil {
+		return n.String(), nil
+	}
+	return "", fmt.Errorf("value must be a string, number or boolean: %s", raw)
+}
+
+// dumpConfig returns the effective config of fs, in the config file format; the values of
+// secretFlags are redacted.
+func dumpConfig(fs *flag.FlagSet) ([]byte, error) {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag || f.Name == dumpConfigFlag {
+			return
+		}
+		config[f.Name] = f.Value.String()
+		if secretFlags[f.Name] && config[f.Name] != "" {
+			config[f.Name] = configRedacted
+		}
+	})
+	return json.MarshalIndent(config, "", "  ")
+}
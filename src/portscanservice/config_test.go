@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newConfigFlags returns a FlagSet with flags of each type, and the config flags.
+func newConfigFlags() (*flag.FlagSet, *string, *int, *time.Duration, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.String("httpport", "8000", "")
+	workers := fs.Int("workers", 100, "")
+	ttl := fs.Duration("resultsttl", 24*time.Hour, "")
+	rdns := fs.Bool("rdns", false, "")
+	fs.String("webhooksecret", "", "")
+	fs.String(configFlag, "", "")
+	fs.Bool(dumpConfigFlag, false, "")
+	return fs, port, workers, ttl, rdns
+}
+
+// TestLoadConfig validates the precedence of flags, environment variables and the config file.
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portscanconfig")
+	if err != nil {
+		t.Fatalf("Error creating directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{"httpport": "9000", "Workers": 200, "resultsttl": "12h", "rdns": true}`), 0600)
+	if err != nil {
+		t.Fatalf("Error writing config: %+v", err)
+	}
+
+	fs, port, workers, ttl, rdns := newConfigFlags()
+	fs.Parse([]string{"-workers=300"})
+	env := map[string]string{"PORTSCAN_CONFIG": path, "PORTSCAN_RESULTSTTL": "1h", "PORTSCAN_WORKERS": "400"}
+	if err := loadConfig(fs, func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("Error loading config: %+v", err)
+	}
+	if *port != "9000" || *workers != 300 || *ttl != time.Hour || !*rdns {
+		t.Errorf("Unexpected config, httpport: %s, workers: %d, resultsttl: %s, rdns: %t", *port, *workers, *ttl, *rdns)
+	}
+
+	// configMap is a map of config file/should_pass pairs.
+	configMap := map[string]bool{`{}`: true, `{"missing": 1}`: false, `{"config": "other.json"}`: false,
+		`{"workers": "many"}`: false, `{"workers": [1]}`: false, `not json`: false}
+	for k, v := range configMap {
+		if err := ioutil.WriteFile(path, []byte(k), 0600); err != nil {
+			t.Fatalf("Error writing config: %+v", err)
+		}
+		fs, _, _, _, _ := newConfigFlags()
+		fs.Parse([]string{"-config=" + path})
+		if err := loadConfig(fs, func(string) string { return "" }); (err == nil) != v {
+			t.Errorf("Config %s was validated incorrectly, error: %+v", k, err)
+		}
+	}
+
+	fs, _, _, _, _ = newConfigFlags()
+	if err := loadConfig(fs, func(k string) string { return map[string]string{"PORTSCAN_WORKERS": "x"}[k] }); err == nil {
+		t.Errorf("Invalid environment variable was not an error")
+	}
+}
+
+// TestDumpConfig validates that the dumped config is a valid config file, with secrets redacted.
+func TestDumpConfig(t *testing.T) {
+	fs, _, _, _, _ := newConfigFlags()
+	fs.Parse([]string{"-workers=300", "-webhooksecret=secret", "-dumpconfig"})
+	b, err := dumpConfig(fs)
+	if err != nil {
+		t.Fatalf("Error dumping config: %+v", err)
+	}
+	config := make(map[string]string)
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatalf("Error parsing config: %+v, config: %s", err, b)
+	}
+	if len(config) != 5 || config["workers"] != "300" || config["resultsttl"] != "24h0m0s" ||
+		config["webhooksecret"] != configRedacted {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+}
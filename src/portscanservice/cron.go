@@ -0,0 +1,138 @@
+package main
+
+// cron.go parses 5 field cron expressions, for schedules.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronExpr is a parsed cron expression; each field is a bitset of the values that match.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are true when the day of month or day of week field starts with '*' (I.E. *
+	// or */2). When both are restricted, a day matches if either matches, as with cron.
+	domAny, dowAny bool
+}
+
+// cronField is the range of values of a cron field.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is also Sunday.
+	{"day of week", 0, 7},
+}
+
+// cronSearchYears limits the search for the next time matching an expression, for expressions
+// that never match, such as February 30.
+const cronSearchYears = 5
+
+// parseCron parses a cron expression of 5 space separated fields: minute, hour, day of month,
+// month and day of week. Each field is '*', or a comma separated list of values or ranges (I.E.
+// 1-5), optionally with a step (I.E. */15 or 0-30/10). Names of months and days are not supported.
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q; must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		var err error
+		if bits[i], err = parseCronField(f, cronFields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q, error: %+v", expr, err)
+		}
+	}
+	// Sunday may be 0 or 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronExpr{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}, nil
+}
+
+// parseCronField returns the bitset of values matching the field f.
+func parseCronField(f string, cf cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step in %s field: %s", cf.name, part)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		lo, hi := cf.min, cf.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %s field: %s", cf.name, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %s field: %s", cf.name, part)
+				}
+			} else if step > 1 {
+				// A single value with a step, I.E. 5/15, runs from the value to the maximum.
+				hi = cf.max
+			}
+		}
+		if lo < cf.min || hi > cf.max || lo > hi {
+			return 0, fmt.Errorf("%s field %s is out of range [%d, %d]", cf.name, part, cf.min, cf.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that matches the expression, in the location of t, or the
+// zero time if there is none within cronSearchYears.
+func (c *cronExpr) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches returns true if the day of t matches the day of month and day of week fields.
+func (c *cronExpr) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
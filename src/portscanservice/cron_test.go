@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseCron validates parsing of valid and invalid expressions.
+func TestParseCron(t *testing.T) {
+	// cronMap is a map of expression/should_pass pairs.
+	cronMap := map[string]bool{"* * * * *": true, "0 2 * * *": true, "*/15 0-6,22-23 1 */2 1-5": true,
+		"0 0 * * 7": true, "5/10 * * * *": true, "* * * *": false, "60 * * * *": false, "* 24 * * *": false,
+		"* * 0 * *": false, "* * * 13 *": false, "* * * * 8": false, "*/0 * * * *": false, "5-1 * * * *": false,
+		"a * * * *": false, "* * * jan *": false}
+	for k, v := range cronMap {
+		_, err := parseCron(k)
+		if (err == nil) != v {
+			t.Errorf("Cron expression %q was parsed incorrectly, error: %+v", k, err)
+		}
+	}
+}
+
+// TestCronNext validates the next time matching an expression.
+func TestCronNext(t *testing.T) {
+	// Wednesday.
+	from := time.Date(2021, 2, 3, 10, 30, 15, 0, time.UTC)
+	type cronTest struct {
+		expr string
+		next time.Time
+	}
+	tests := []cronTest{
+		{"* * * * *", time.Date(2021, 2, 3, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2021, 2, 4, 2, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2021, 2, 3, 10, 40, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2021, 2, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, 2, 7, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week, when both are restricted.
+		{"0 0 10 * 5", time.Date(2021, 2, 5, 0, 0, 0, 0, time.UTC)},
+		// A field starting with '*' counts as '*', so both must match: an odd day that is a Monday.
+		{"0 0 */2 * 1", time.Date(2021, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, v := range tests {
+		c, err := parseCron(v.expr)
+		if err != nil {
+			t.Errorf("Error parsing %q: %+v", v.expr, err)
+			continue
+		}
+		if next := c.next(from); !next.Equal(v.next) {
+			t.Errorf("Unexpected next time for %q: %s, expected: %s", v.expr, next, v.next)
+		}
+	}
+}
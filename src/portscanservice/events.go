@@ -0,0 +1,100 @@
+package main
+
+// events.go streams the state, progress and results of a job as Server-Sent Events, so the CLI or
+// a browser (EventSource) can show results as they complete instead of polling. The events are the
+// scan.Stream* events; progress updates close together may be combined.
+// A client that reconnects with the Last-Event-ID header receives the results after that index.
+// Hostnames from reverse DNS are only in the final results, from GET /v2/scans/{id}.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+const (
+	// v2Events is the path segment, following a scan ID, of the event stream.
+	v2Events = "events"
+
+	// eventsKeepalive is the interval of comments sent so idle streams are not closed by proxies.
+	eventsKeepalive = 15 * time.Second
+)
+
+// v2ScanEvents streams the events of the job with the specified ID until it is done, or the client
+// disconnects.
+func v2ScanEvents(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil && last >= 0 {
+		next = last + 1
+	}
+
+	if *allowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", *allowOrigin)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	last := scan.Job{}
+	for {
+		// The snapshot is taken before the results, so the results are final once it is done.
+		sj := j.snapshot(false)
+		results, changed := j.watch(next)
+		for i := range results {
+			writeEvent(w, scan.StreamResult, strconv.Itoa(next+i), results[i])
+		}
+		next += len(results)
+
+		switch {
+		case sj.Done():
+			writeEvent(w, scan.StreamDone, "", sj)
+			flusher.Flush()
+			return
+		case sj.State != last.State || sj.Position != last.Position:
+			writeEvent(w, scan.StreamState, "", sj)
+		case sj.Progress != last.Progress:
+			writeEvent(w, scan.StreamProgress, "", sj.Progress)
+		}
+		last = sj
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes an event with data v as JSON, and the ID id if it is not empty. Write errors
+// are not returned; a client that disconnected is detected from the request context.
+func writeEvent(w http.ResponseWriter, event string, id string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("ERROR: marshalling %s event, error: %+v\n", event, err)
+		return
+	}
+	out := "event: " + event + "\n"
+	if id != "" {
+		out += "id: " + id + "\n"
+	}
+	fmt.Fprintf(w, "%sdata: %s\n\n", out, b)
+}
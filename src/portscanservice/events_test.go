@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// readEvents GETs the event stream at path, with the Last-Event-ID lastID if it is not empty, and
+// sends each event to the returned channel, which is closed when the stream ends.
+func readEvents(t *testing.T, ts *httptest.Server, path string, lastID string) <-chan scan.StreamEvent {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %+v", err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response, status: %d, headers: %+v", resp.StatusCode, resp.Header)
+	}
+	events := make(chan scan.StreamEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		scan.ReadStream(resp.Body, func(ev scan.StreamEvent) bool {
+			events <- ev
+			return true
+		})
+	}()
+	return events
+}
+
+// TestScanEvents validates the events streamed while a job runs, and resuming a stream.
+func TestScanEvents(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	if status, body := doV2(t, ts, http.MethodGet, v2ScansPath+"/not_an_id/"+v2Events, ""); status != http.StatusNotFound {
+		t.Errorf("Unexpected response for an unknown ID, status: %d, body: %s", status, body)
+	}
+
+	req := scanRequest{ips: []string{"127.0.0.1", "127.0.0.2"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	j, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	path := v2ScansPath + "/" + j.id + "/" + v2Events
+	events := readEvents(t, ts, path, "")
+	if ev := <-events; ev.Event != scan.StreamState {
+		t.Errorf("Unexpected first event: %+v", ev)
+	}
+
+	go j.run(nil)
+	got := map[string]int{}
+	ids := []string{}
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			got[ev.Event]++
+			if ev.Event == scan.StreamResult {
+				ids = append(ids, ev.ID)
+			}
+			if ev.Event == scan.StreamDone {
+				sj := scan.Job{}
+				if json.Unmarshal([]byte(ev.Data), &sj) != nil || sj.State != scan.JobCompleted {
+					t.Errorf("Unexpected done event: %+v", ev)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the stream to end, events: %+v", got)
+		}
+	}
+	if got[scan.StreamResult] != 2 || got[scan.StreamDone] != 1 || ids[0] != "0" || ids[1] != "1" {
+		t.Errorf("Unexpected events: %+v, result IDs: %+v", got, ids)
+	}
+
+	// A stream of a done job resumed after the first result has the second result, then done.
+	resumed := []scan.StreamEvent{}
+	for ev := range readEvents(t, ts, path, "0") {
+		resumed = append(resumed, ev)
+	}
+	if len(resumed) != 2 || resumed[0].ID != "1" || resumed[1].Event != scan.StreamDone {
+		t.Errorf("Unexpected resumed events: %+v", resumed)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+// filter.go filters, sorts and pages results, for the results query and GET
+// /v2/scans/{id}/results. The query keys are:
+// state    a CSV list of scan.State* states, I.E. state=open.
+// ip       a CSV list of IPs or CIDRs, I.E. ip=10.0.0.0/24.
+// port     a CSV list of ports.
+// service  a CSV list of service names, I.E. service=ssh,https, matched by their TCP port.
+// sort     ip, port or state, optionally prefixed by - for descending order; ties are ordered by
+//          IP, then port. Default is the order in which results completed.
+// limit    the maximum number of results to return; scan.CursorHeader is set if there are more.
+// cursor   the value of scan.CursorHeader, to get the next page.
+// A cursor identifies the last result returned rather than an offset, so pages do not skip or
+// repeat results as a running scan adds results.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+const (
+	cmdState   = "state"
+	cmdIP      = "ip"
+	cmdPort    = "port"
+	cmdService = "service"
+	cmdSort    = "sort"
+	cmdLimit   = "limit"
+	cmdCursor  = "cursor"
+
+	sortIP    = "ip"
+	sortPort  = "port"
+	sortState = "state"
+)
+
+// resultsKeys are the query keys that may be given with results.
+var resultsKeys = []string{cmdFormat, cmdState, cmdIP, cmdPort, cmdService, cmdSort, cmdLimit, cmdCursor}
+
+// resultsQuery is a validated filter, sort and page of results.
+type resultsQuery struct {
+	states map[string]bool
+	nets   []*net.IPNet
+	ports  map[string]bool
+	// sort is one of the sort* keys, or empty for the order in which results completed.
+	sort string
+	desc bool
+	// limit is the maximum number of results; zero for no limit.
+	limit int
+	// after is the cursor of the last result of the previous page, if any.
+	after *resultsCursor
+}
+
+// resultsCursor identifies a result in the order of a resultsQuery; it is sent to clients hex
+// encoded, so it is not changed by the case insensitive query string API.
+type resultsCursor struct {
+	Sort string
+	// Index is the index of the result in the results of the job.
+	Index int
+	IP    string
+	Port  string
+	State string
+}
+
+// indexedResult is a result and its index in the results of the job.
+type indexedResult struct {
+	index int
+	scan.Result
+}
+
+// parseResultsQuery validates the query keys in resultsKeys.
+func parseResultsQuery(qs url.Values) (resultsQuery, error) {
+	q := resultsQuery{}
+	if v := qs.Get(cmdState); v != "" {
+		q.states = make(map[string]bool)
+		for _, s := range strings.Split(v, ",") {
+			switch s {
+			case scan.StateOpen, scan.StateClosed, scan.StateFiltered, scan.StateNotScanned:
+				q.states[s] = true
+			default:
+				return resultsQuery{}, fmt.Errorf("invalid state %s; must be %s, %s, %s or %s", s,
+					scan.StateOpen, scan.StateClosed, scan.StateFiltered, scan.StateNotScanned)
+			}
+		}
+	}
+
+	if v := qs.Get(cmdIP); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			if !strings.Contains(s, "/") {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return resultsQuery{}, fmt.Errorf("invalid ip %s; must be an IP or CIDR", s)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				q.nets = append(q.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return resultsQuery{}, fmt.Errorf("invalid ip %s; must be an IP or CIDR", s)
+			}
+			q.nets = append(q.nets, n)
+		}
+	}
+
+	if v := qs.Get(cmdPort); v != "" {
+		q.ports = make(map[string]bool)
+		for _, s := range strings.Split(v, ",") {
+			p, err := scan.ValidatePort(s)
+			if err != nil {
+				return resultsQuery{}, err
+			}
+			q.ports[p] = true
+		}
+	}
+	if v := qs.Get(cmdService); v != "" {
+		if q.ports == nil {
+			q.ports = make(map[string]bool)
+		}
+		for _, s := range strings.Split(v, ",") {
+			p, err := net.LookupPort("tcp", s)
+			if err != nil {
+				return resultsQuery{}, fmt.Errorf("invalid service %s; must be a known TCP service name", s)
+			}
+			q.ports[strconv.Itoa(p)] = true
+		}
+	}
+
+	if v := qs.Get(cmdSort); v != "" {
+		q.sort, q.desc = strings.TrimPrefix(v, "-"), strings.HasPrefix(v, "-")
+		if q.sort != sortIP && q.sort != sortPort && q.sort != sortState {
+			return resultsQuery{}, fmt.Errorf("invalid sort %s; must be %s, %s or %s, optionally prefixed by -",
+				v, sortIP, sortPort, sortState)
+		}
+	}
+
+	if v := qs.Get(cmdLimit); v != "" {
+		var err error
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 {
+			return resultsQuery{}, fmt.Errorf("invalid limit %s; must be an integer > 0", v)
+		}
+	}
+
+	if v := qs.Get(cmdCursor); v != "" {
+		b, err := hex.DecodeString(v)
+		c := resultsCursor{}
+		if err != nil || json.Unmarshal(b, &c) != nil || c.Sort != qs.Get(cmdSort) {
+			return resultsQuery{}, fmt.Errorf("invalid cursor %s; use the value of %s, with the same sort", v, scan.CursorHeader)
+		}
+		q.after = &c
+	}
+	return q, nil
+}
+
+// matches returns true if r passes the filters of q.
+func (q resultsQuery) matches(r scan.Result) bool {
+	if q.states != nil && !q.states[r.State()] {
+		return false
+	}
+	if q.ports != nil && !q.ports[r.Port] {
+		return false
+	}
+	if q.nets == nil {
+		return true
+	}
+	// IPv6 addresses are bracketed in results.
+	ip := net.ParseIP(strings.Trim(r.IP, "[]"))
+	for _, n := range q.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// less returns true if a orders before b.
+func (q resultsQuery) less(a resultsCursor, b resultsCursor) bool {
+	if q.sort == "" {
+		return a.Index < b.Index
+	}
+	// order returns the order of a and b given whether each is less than the other.
+	order := func(aLess bool, bLess bool) int {
+		switch {
+		case aLess:
+			return -1
+		case bLess:
+			return 1
+		}
+		return 0
+	}
+	c := 0
+	switch q.sort {
+	case sortPort:
+		c = order(scan.PortLess(a.Port, b.Port), scan.PortLess(b.Port, a.Port))
+	case sortState:
+		c = strings.Compare(a.State, b.State)
+	}
+	if c == 0 {
+		c = order(scan.IPLess(a.IP, b.IP), scan.IPLess(b.IP, a.IP))
+	}
+	if c == 0 {
+		c = order(scan.PortLess(a.Port, b.Port), scan.PortLess(b.Port, a.Port))
+	}
+	if c == 0 {
+		c = a.Index - b.Index
+	}
+	if q.desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// cursor returns the cursor of r.
+func (q resultsQuery) cursor(r indexedResult) resultsCursor {
+	s := q.sort
+	if q.desc {
+		s = "-" + s
+	}
+	return resultsCursor{Sort: s, Index: r.index, IP: r.IP, Port: r.Port, State: r.State()}
+}
+
+// apply returns the page of results for q, and the cursor of the next page, or an empty string if
+// this is the last page.
+func (q resultsQuery) apply(results scan.Results) (scan.Results, string) {
+	matched := []indexedResult{}
+	for i := range results {
+		if q.matches(results[i]) {
+			ir := indexedResult{index: i, Result: results[i]}
+			if q.after == nil || q.less(*q.after, q.cursor(ir)) {
+				matched = append(matched, ir)
+			}
+		}
+	}
+	sort.SliceStable(matched, func(i, k int) bool { return q.less(q.cursor(matched[i]), q.cursor(matched[k])) })
+
+	next := ""
+	if q.limit > 0 && len(matched) > q.limit {
+		matched = matched[:q.limit]
+		b, _ := json.Marshal(q.cursor(matched[len(matched)-1]))
+		next = hex.EncodeToString(b)
+	}
+	page := make(scan.Results, len(matched))
+	for i := range matched {
+		page[i] = matched[i].Result
+	}
+	return page, next
+}
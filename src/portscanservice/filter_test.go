@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// filterResults are results for the filter tests, in the order they completed.
+func filterResults() scan.Results {
+	open, refused, timeout := scan.NoError, "connect: connection refused", "i/o timeout"
+	return scan.Results{
+		{IP: "10.0.0.10", Port: "22", Error: &open},
+		{IP: "10.0.0.2", Port: "443", Error: &refused},
+		{IP: "10.0.0.2", Port: "22", Error: &open},
+		{IP: "192.168.1.1", Port: "80", Error: &timeout},
+		{IP: "[::1]", Port: "22", Error: &refused},
+		{IP: "10.0.0.1", Port: "443", Error: &open},
+		{IP: "[2001:db8::1]", Port: "80", Error: &timeout},
+	}
+}
+
+// TestParseResultsQuery validates the results query keys.
+func TestParseResultsQuery(t *testing.T) {
+	// queryMap is a map of query/should_pass pairs.
+	queryMap := map[string]bool{"": true, "state=open,closed": true, "state=up": false, "ip=10.0.0.1,10.0.0.0/8,::1": true,
+		"ip=10.0.0": false, "ip=10.0.0.0/33": false, "port=22,443": true, "port=65536": false, "service=ssh,https": true,
+		"service=not-a-service": false, "sort=ip": true, "sort=-state": true, "sort=name": false, "limit=10": true,
+		"limit=0": false, "cursor=zz": false, "cursor=7b7d": true, "sort=ip&cursor=7b7d": false}
+	for k, v := range queryMap {
+		qs, _ := url.ParseQuery(k)
+		if _, err := parseResultsQuery(qs); (err == nil) != v {
+			t.Errorf("Query %q was validated incorrectly, error: %+v", k, err)
+		}
+	}
+}
+
+// TestResultsQueryApply validates filtering and sorting.
+func TestResultsQueryApply(t *testing.T) {
+	type applyTest struct {
+		query string
+		ips   []string
+	}
+	tests := []applyTest{
+		{"", []string{"10.0.0.10", "10.0.0.2", "10.0.0.2", "192.168.1.1", "[::1]", "10.0.0.1", "[2001:db8::1]"}},
+		{"state=open", []string{"10.0.0.10", "10.0.0.2", "10.0.0.1"}},
+		{"ip=10.0.0.0/29,::1", []string{"10.0.0.2", "10.0.0.2", "[::1]", "10.0.0.1"}},
+		{"ip=2001:db8::/32", []string{"[2001:db8::1]"}},
+		{"ip=2001:db8::1", []string{"[2001:db8::1]"}},
+		{"ip=10.0.0.2&port=22", []string{"10.0.0.2"}},
+		{"service=ssh&state=open", []string{"10.0.0.10", "10.0.0.2"}},
+		{"sort=ip", []string{"[::1]", "10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.10", "192.168.1.1", "[2001:db8::1]"}},
+		{"sort=-port", []string{"10.0.0.2", "10.0.0.1", "[2001:db8::1]", "192.168.1.1", "10.0.0.10", "10.0.0.2", "[::1]"}},
+		{"sort=state", []string{"[::1]", "10.0.0.2", "192.168.1.1", "[2001:db8::1]", "10.0.0.1", "10.0.0.2", "10.0.0.10"}},
+	}
+	for _, v := range tests {
+		qs, _ := url.ParseQuery(v.query)
+		q, err := parseResultsQuery(qs)
+		if err != nil {
+			t.Errorf("Error parsing %q: %+v", v.query, err)
+			continue
+		}
+		page, next := q.apply(filterResults())
+		ips := []string{}
+		for _, r := range page {
+			ips = append(ips, r.IP)
+		}
+		if next != "" || len(ips) != len(v.ips) {
+			t.Errorf("Unexpected results for %q: %+v, next: %s", v.query, ips, next)
+			continue
+		}
+		for i := range ips {
+			if ips[i] != v.ips[i] {
+				t.Errorf("Unexpected results for %q: %+v, expected: %+v", v.query, ips, v.ips)
+				break
+			}
+		}
+	}
+}
+
+// TestResultsQueryPages validates that paging returns every result once, including results added
+// between pages.
+func TestResultsQueryPages(t *testing.T) {
+	for _, sort := range []string{"", "ip", "-port"} {
+		results := filterResults()
+		pages, total := 0, 0
+		seen := map[string]bool{}
+		cursor := ""
+		for {
+			qs := url.Values{cmdLimit: {"2"}, cmdSort: {sort}, cmdCursor: {cursor}}
+			q, err := parseResultsQuery(qs)
+			if err != nil {
+				t.Fatalf("Error parsing %+v: %+v", qs, err)
+			}
+			page, next := q.apply(results)
+			for _, r := range page {
+				seen[r.IP+r.Port] = true
+			}
+			pages++
+			total += len(page)
+			if pages == 1 {
+				// A result added by a running scan, that orders after the first page.
+				open := scan.NoError
+				results = append(results, scan.Result{IP: "192.168.1.2", Port: "23", Error: &open})
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if pages != 4 || total != 8 || len(seen) != 8 {
+			t.Errorf("Unexpected pages for sort %q, pages: %d, results: %d, distinct: %d", sort, pages, total, len(seen))
+		}
+	}
+}
+
+// TestResultsQueryAPI validates the cursor header and errors of the results query and v2 API.
+func TestResultsQueryAPI(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+	j := doneJob(jobs, filterResults(), 0)
+
+	for _, path := range []string{"/?results=" + j.id + "&limit=2", v2ScansPath + "/" + j.id + "/" + v2Results + "?limit=2"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Error from get, error: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(scan.CursorHeader) == "" {
+			t.Errorf("Unexpected response for %s, status: %d, headers: %+v", path, resp.StatusCode, resp.Header)
+		}
+	}
+
+	tests := []v2Test{
+		{http.MethodGet, "/?results=" + j.id + "&state=up", ``, http.StatusBadRequest},
+		{http.MethodGet, "/?status=" + j.id + "&state=open", ``, http.StatusBadRequest},
+		{http.MethodGet, v2ScansPath + "/" + j.id + "/" + v2Results + "?sort=name", ``, http.StatusBadRequest},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+// jobs.go tracks each scan as a job, from when it is requested until its results are removed,
+// so callers can tell a scan that is still running from an unknown ID.
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// job is a requested scan. Fields other than id, req, ctx, cancel and held are protected by mu.
+type job struct {
+	mu  sync.Mutex
+	id  string
+	req scanRequest
+	// ctx is cancelled to stop the job issuing probes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	state    string
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	progress scan.Progress
+	results  scan.Results
+	// err is set when the job failed.
+	err string
+	// expires and size are set by jobStore.retain once the job is done.
+	expires time.Time
+	size    int
+	// resumed is the number of results kept from before a restart; see resumeJob.
+	resumed int
+	// checkpointed is when the job was last saved while running.
+	checkpointed time.Time
+	// unpaused is closed when a paused job is resumed; nil when the job is not paused.
+	unpaused chan struct{}
+	// held is 1 while the job is paused, so the scheduler does not start it if it is queued. It is
+	// set holding mu, and read atomically by the scheduler, which never takes mu.
+	held int32
+	// interrupted is set by interrupt, when the job is stopped to be resumed after a restart.
+	interrupted bool
+	// saveMu serializes saves of the job, so an older record never replaces a newer one. It is
+	// taken before mu.
+	saveMu sync.Mutex
+	// changed is closed when the state, progress or results of the job change; nil until watch is
+	// called. See notifyLocked.
+	changed chan struct{}
+}
+
+// pauseLimiter holds connection attempts of a job while it is paused, then passes them to next.
+type pauseLimiter struct {
+	j    *job
+	next scan.Limiter
+}
+
+// newJob adds a queued job for req to the jobs store.
+func newJob(req scanRequest) (*job, error) {
+	id, err := uniqueID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{id: id, req: req, state: scan.JobQueued, created: time.Now(),
+		progress: scan.Progress{Total: len(req.ips)}}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	if err := jobs.add(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// run runs the scan for the job, with connection attempts held by limiter if it is not nil, and
+// retains the job in the store once it is done. Only targets without a result are probed. While
+// running, the job is saved every checkpointinterval. A panic during the scan fails the job. An
+// interrupted job is not done once run returns.
+func (j *job) run(limiter scan.Limiter) {
+	suspended := false
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("ERROR: job %s failed: %+v\n%s", j.id, err, string(debug.Stack()))
+			j.finish(scan.JobFailed, nil, fmt.Sprintf("%+v", err))
+		} else if suspended {
+			return
+		}
+		jobs.retain(j)
+		notifyDone(j)
+	}()
+
+	j.mu.Lock()
+	if j.state != scan.JobPaused {
+		j.state = scan.JobRunning
+	}
+	j.started = time.Now()
+	j.checkpointed = j.started
+	kept := append(scan.Results{}, j.results...)
+	j.resumed = len(kept)
+	j.progress = scan.NewProgress(j.resumed, len(j.req.ips), j.started, j.started)
+	j.notifyLocked()
+	j.mu.Unlock()
+
+	ctx, cancel := j.ctx, j.cancel
+	if j.req.budget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, j.req.budget)
+	}
+	defer cancel()
+	defer j.cancel()
+	settings := j.req.settings
+	settings.Limiter = &pauseLimiter{j: j, next: limiter}
+	rslts := append(kept, scan.Scan(ctx, j.req.port, remainingIPs(j.req.ips, kept), settings, j.setProgress)...)
+	if j.req.rdns && j.ctx.Err() == nil {
+		scan.ReverseLookup(j.ctx, rslts, resolver, *rdnsConcurrency)
+	}
+	if suspended = j.suspend(rslts); !suspended {
+		j.finish(scan.JobCompleted, rslts, "")
+	}
+}
+
+// interrupt stops a running job issuing new probes, without finishing it, so it is saved and
+// resumed after a restart; see run. Returns false if the job is not running.
+func (j *job) interrupt() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.started.IsZero() || (j.state != scan.JobRunning && j.state != scan.JobPaused) {
+		return false
+	}
+	j.interrupted = true
+	j.cancel()
+	return true
+}
+
+// suspend keeps results as the results of an interrupted job, which is left running. Returns false
+// if the job was not interrupted.
+func (j *job) suspend(results scan.Results) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.interrupted {
+		return false
+	}
+	j.results = results
+	j.notifyLocked()
+	return true
+}
+
+// requestCancel stops the job issuing new probes; results of probes already completed or in flight
+// are kept, and the job moves to the cancelled state once in flight probes complete. A queued job
+// is removed from the queue and cancelled at once, with its targets not scanned.
+// Returns false if the job is already done.
+func (j *job) requestCancel() bool {
+	j.mu.Lock()
+	if j.state != scan.JobQueued && j.state != scan.JobRunning && j.state != scan.JobPaused {
+		j.mu.Unlock()
+		return false
+	}
+	j.cancel()
+	queued := j.started.IsZero()
+	results := append(scan.Results{}, j.results...)
+	j.mu.Unlock()
+
+	// Not called holding mu, so job and scheduler locks are never nested.
+	if !queued || !scheduler.remove(j) {
+		return true
+	}
+	for _, ip := range remainingIPs(j.req.ips, results) {
+		ns := scan.NotScanned
+		results = append(results, scan.Result{IP: ip, Port: j.req.port, Error: &ns})
+	}
+	j.finish(scan.JobCancelled, results, "")
+	jobs.retain(j)
+	notifyDone(j)
+	return true
+}
+
+// pause stops the job starting connection attempts until unpause is called; attempts in flight
+// complete. A queued job is not started while paused, so does not hold a place among the running
+// jobs. Returns false if the job is not queued or running.
+func (j *job) pause() bool {
+	j.mu.Lock()
+	if j.state != scan.JobQueued && j.state != scan.JobRunning {
+		j.mu.Unlock()
+		return false
+	}
+	j.state = scan.JobPaused
+	j.unpaused = make(chan struct{})
+	atomic.StoreInt32(&j.held, 1)
+	j.notifyLocked()
+	j.mu.Unlock()
+	jobs.save(j)
+	return true
+}
+
+// unpause resumes a paused job. Returns false if the job is not paused.
+func (j *job) unpause() bool {
+	j.mu.Lock()
+	if j.state != scan.JobPaused {
+		j.mu.Unlock()
+		return false
+	}
+	j.state = scan.JobRunning
+	if j.started.IsZero() {
+		j.state = scan.JobQueued
+	}
+	close(j.unpaused)
+	j.unpaused = nil
+	atomic.StoreInt32(&j.held, 0)
+	j.notifyLocked()
+	j.mu.Unlock()
+	jobs.save(j)
+	// The job may be queued, and was passed over while paused.
+	scheduler.start()
+	return true
+}
+
+// Acquire waits while the job is paused, then acquires next.
+func (pl *pauseLimiter) Acquire(ctx context.Context) error {
+	pl.j.mu.Lock()
+	unpaused := pl.j.unpaused
+	pl.j.mu.Unlock()
+	if unpaused != nil {
+		select {
+		case <-unpaused:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if pl.next == nil {
+		return nil
+	}
+	return pl.next.Acquire(ctx)
+}
+
+// Release releases next.
+func (pl *pauseLimiter) Release() {
+	if pl.next != nil {
+		pl.next.Release()
+	}
+}
+
+// resumeJob queues j, which was not done when the service stopped, to probe the targets without
+// a result; the results of targets that were probed are kept, and a paused job stays paused. If j
+// cannot be queued, or its targets are no longer permitted by the target policy, it is failed.
+func resumeJob(j *job) {
+	j.mu.Lock()
+	paused := j.state == scan.JobPaused
+	kept := scan.Results{}
+	for _, r := range j.results {
+		if r.Error == nil || *r.Error != scan.NotScanned {
+			kept = append(kept, r)
+		}
+	}
+	j.state = scan.JobQueued
+	if paused {
+		j.state = scan.JobPaused
+		j.unpaused = make(chan struct{})
+		atomic.StoreInt32(&j.held, 1)
+	}
+	j.results = kept
+	j.started = time.Time{}
+	j.progress = scan.NewProgress(len(kept), len(j.req.ips), time.Time{}, time.Time{})
+	j.notifyLocked()
+	j.mu.Unlock()
+
+	reason := ""
+	if err := policy.permittedIPs(j.req.ips); err != nil {
+		fmt.Printf("WARNING: not resuming job %s, error: %+v\n", j.id, err)
+		reason = fmt.Sprintf("%s; %+v", interruptedError, err)
+	} else if err := scheduler.submit(j); err != nil {
+		fmt.Printf("ERROR: resuming job %s, error: %+v\n", j.id, err)
+		reason = interruptedError
+	}
+	if reason != "" {
+		j.finish(scan.JobFailed, kept, reason)
+		jobs.retain(j)
+		notifyDone(j)
+		return
+	}
+	fmt.Printf("INFO: resuming job %s, %d of %d targets have results.\n", j.id, len(kept), len(j.req.ips))
+}
+
+// remainingIPs returns ips without those that have a result in results.
+func remainingIPs(ips []string, results scan.Results) []string {
+	done := make(map[string]int)
+	for _, r := range results {
+		done[r.IP]++
+	}
+	out := []string{}
+	for _, ip := range ips {
+		if done[ip] > 0 {
+			done[ip]--
+			continue
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// setProgress is the scan.ProgressFunc for the job; results are collected as they complete so
+// they are available before the job is done, and the job is saved every checkpointinterval.
+// Progress includes results kept from before a restart.
+func (j *job) setProgress(p scan.Progress, r scan.Result) {
+	j.mu.Lock()
+	p.Completed += j.resumed
+	p.Total += j.resumed
+	if p.Total > 0 {
+		p.Percent = 100 * float64(p.Completed) / float64(p.Total)
+	}
+	j.progress = p
+	j.results = append(j.results, r)
+	j.notifyLocked()
+	checkpoint := time.Since(j.checkpointed) >= *checkpointInterval
+	if checkpoint {
+		j.checkpointed = time.Now()
+	}
+	j.mu.Unlock()
+
+	if checkpoint {
+		jobs.save(j)
+	}
+}
+
+// finish moves the job to the specified terminal state, replacing the results collected so far
+// with the final results. A job that would complete after cancel was requested is cancelled.
+func (j *job) finish(state string, results scan.Results, err string) {
+	j.mu.Lock()
+	if state == scan.JobCompleted && j.ctx.Err() != nil {
+		state = scan.JobCancelled
+	}
+	j.state = state
+	j.finished = time.Now()
+	j.results = results
+	j.err = err
+	j.notifyLocked()
+	j.mu.Unlock()
+}
+
+// watch returns the results of the job from index next, and a channel that is closed at the next
+// change to the job.
+func (j *job) watch(next int) (scan.Results, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.changed == nil {
+		j.changed = make(chan struct{})
+	}
+	if next > len(j.results) {
+		next = len(j.results)
+	}
+	return append(scan.Results{}, j.results[next:]...), j.changed
+}
+
+// notifyLocked wakes callers waiting on the channel returned by watch; call holding mu after any
+// change to the state, progress or results.
+func (j *job) notifyLocked() {
+	if j.changed != nil {
+		close(j.changed)
+		j.changed = nil
+	}
+}
+
+// snapshot returns the job as a scan.Job; results are included if includeResults is true,
+// and are partial if the job is not done.
+func (j *job) snapshot(includeResults bool) scan.Job {
+	j.mu.Lock()
+	sj := scan.Job{ID: j.id, State: j.state, Priority: j.req.priority, ScheduleID: j.req.scheduleID,
+		Created: j.created, Finished: j.finished, Expires: j.expires, Error: j.err, Progress: j.progress}
+	if includeResults {
+		sj.Partial = !sj.Done()
+		sj.Results = append(scan.Results{}, j.results...)
+	}
+	j.mu.Unlock()
+
+	// Not called holding mu, so job and scheduler locks are never nested.
+	if sj.State == scan.JobQueued {
+		sj.Position = scheduler.position(j)
+	}
+	return sj
+}
+
+// expired returns true if the job is done and its TTL expired before now.
+func (j *job) expired(now time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.expires.IsZero() && now.After(j.expires)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestJobLifecycle validates job states, and that results requests return partial results for a
+// job that is not done.
+func TestJobLifecycle(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
+	defer ts.Close()
+
+	req := scanRequest{ips: []string{"127.0.0.1"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	j, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	if sj := j.snapshot(true); sj.State != scan.JobQueued || sj.Done() || !sj.Partial || len(sj.Results) != 0 {
+		t.Errorf("Unexpected new job: %+v", sj)
+	}
+
+	resp, err := http.Get(ts.URL + "?results=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get(scan.PartialHeader) != "true" ||
+		strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("Unexpected response for results of a queued job, status: %d, body: %s", resp.StatusCode, body)
+	}
+
+	// Results collected while running are returned, as partial, without removing the job.
+	refused := "connection refused"
+	j.setProgress(scan.NewProgress(1, 2, time.Now(), time.Now()), scan.Result{IP: "127.0.0.1", Port: "4430",
+		Error: &refused})
+	if sj := j.snapshot(true); !sj.Partial || len(sj.Results) != 1 || sj.Percent != 50 {
+		t.Errorf("Unexpected partial job: %+v", sj)
+	}
+	resp, err = http.Get(ts.URL + "?results=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get(scan.PercentHeader) != "50.0" {
+		t.Errorf("Unexpected response for partial results, status: %d, headers: %+v", resp.StatusCode, resp.Header)
+	}
+	if _, ok := jobs.get(j.id); !ok {
+		t.Errorf("Job was removed after partial results were read")
+	}
+
+	j.run(nil)
+	sj := j.snapshot(true)
+	if sj.State != scan.JobCompleted || sj.Partial || len(sj.Results) != 1 || sj.Finished.Before(sj.Started) {
+		t.Errorf("Unexpected completed job: %+v", sj)
+	}
+
+	resp, err = http.Get(ts.URL + "?results=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status for results of a completed job: %d", resp.StatusCode)
+	}
+	if _, ok := jobs.get(j.id); !ok {
+		t.Errorf("Job was removed after results were read")
+	}
+}
+
+// TestCancel validates cancelling a job, and that cancelling a job that is done is a conflict.
+func TestCancel(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	req := scanRequest{ips: []string{"127.0.0.1", "127.0.0.2"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	j, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "?cancel=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Unexpected status cancelling a queued job: %d", resp.StatusCode)
+	}
+
+	j.run(nil)
+	sj := j.snapshot(true)
+	if sj.State != scan.JobCancelled || sj.Partial || len(sj.Results) != len(req.ips) {
+		t.Errorf("Unexpected cancelled job: %+v", sj)
+	}
+	for _, r := range sj.Results {
+		if r.Error == nil || *r.Error != scan.NotScanned {
+			t.Errorf("Unexpected result for a cancelled job: %+v", r)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "?cancel=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Unexpected status cancelling a cancelled job: %d", resp.StatusCode)
+	}
+	if status, body := doV2(t, ts, http.MethodPost, v2ScansPath+"/"+j.id+"/"+cmdCancel, ""); status != http.StatusConflict {
+		t.Errorf("Unexpected response cancelling a cancelled job, status: %d, body: %s", status, body)
+	}
+}
+
+// TestCancelQueued validates that a cancelled queued job is removed from the queue and cancelled at
+// once, so it no longer counts towards maxqueued or the positions of other jobs.
+func TestCancelQueued(t *testing.T) {
+	defaultScheduler := scheduler
+	scheduler = newJobScheduler(1, 0, 2)
+	defer func() { scheduler = defaultScheduler }()
+
+	req := scanRequest{ips: []string{"127.0.0.1", "127.0.0.2"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	queued := []*job{}
+	for i := 0; i < 2; i++ {
+		j, err := newJob(req)
+		if err != nil {
+			t.Fatalf("Error creating job: %+v", err)
+		}
+		if err := scheduler.submit(j); err != nil {
+			t.Fatalf("Error submitting job: %+v", err)
+		}
+		queued = append(queued, j)
+	}
+
+	if !queued[0].requestCancel() {
+		t.Errorf("Queued job was not cancelled")
+	}
+	sj := queued[0].snapshot(true)
+	if sj.State != scan.JobCancelled || sj.Position != 0 || len(sj.Results) != len(req.ips) {
+		t.Errorf("Unexpected cancelled job: %+v", sj)
+	}
+	for _, r := range sj.Results {
+		if r.Error == nil || *r.Error != scan.NotScanned {
+			t.Errorf("Unexpected result for a cancelled job: %+v", r)
+		}
+	}
+	if sj := queued[1].snapshot(false); sj.Position != 1 {
+		t.Errorf("Unexpected position of the job behind a cancelled job: %+v", sj)
+	}
+	j, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	if err := scheduler.submit(j); err != nil {
+		t.Errorf("Cancelled job still counts towards maxqueued, error: %+v", err)
+	}
+}
+
+// TestResume validates that a resumed job probes only the targets without a result, and that a job
+// that cannot be queued, or with targets that are no longer permitted, is failed.
+func TestResume(t *testing.T) {
+	defaultScheduler, defaultPolicy := scheduler, policy
+	scheduler = newJobScheduler(1, 0, 1)
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { scheduler, policy = defaultScheduler, defaultPolicy }()
+
+	kept, notScanned := "kept", scan.NotScanned
+	rec := jobRecord{Job: scan.Job{ID: "resume-id", State: scan.JobRunning, Created: time.Now(),
+		Results: scan.Results{{IP: "127.0.0.1", Port: "4430", Error: &kept},
+			{IP: "127.0.0.2", Port: "4430", Error: &notScanned}}},
+		Request: requestRecord{IPs: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, Port: "4430",
+			Settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}}
+	j := jobFromRecord(rec)
+	jobs.add(j)
+	resumeJob(j)
+	sj := j.snapshot(true)
+	if sj.State != scan.JobQueued || sj.Position != 1 || len(sj.Results) != 1 || sj.Completed != 1 {
+		t.Errorf("Unexpected resumed job: %+v", sj)
+	}
+
+	j.run(nil)
+	sj = j.snapshot(true)
+	if sj.State != scan.JobCompleted || len(sj.Results) != 3 || *sj.Results[0].Error != kept || sj.Percent != 100 {
+		t.Errorf("Unexpected completed job: %+v", sj)
+	}
+
+	failed := jobFromRecord(jobRecord{Job: scan.Job{ID: "failed-id", State: scan.JobQueued}})
+	jobs.add(failed)
+	resumeJob(failed)
+	if sj := failed.snapshot(false); sj.State != scan.JobFailed || sj.Error != interruptedError {
+		t.Errorf("Unexpected job resumed with the queue full: %+v", sj)
+	}
+
+	policy = defaultPolicy
+	denied := jobFromRecord(rec)
+	denied.id = "denied-id"
+	jobs.add(denied)
+	resumeJob(denied)
+	if sj := denied.snapshot(true); sj.State != scan.JobFailed || !strings.HasPrefix(sj.Error, interruptedError+"; ") ||
+		len(sj.Results) != 1 || scheduler.position(denied) != 0 {
+		t.Errorf("Unexpected job resumed with targets that are not permitted: %+v", sj)
+	}
+}
+
+// waitDone waits for j to be done, and returns its snapshot including results.
+func waitDone(t *testing.T, j *job) scan.Job {
+	timeout := time.After(5 * time.Second)
+	for {
+		_, changed := j.watch(0)
+		if sj := j.snapshot(true); sj.Done() {
+			return sj
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for job %s: %+v", j.id, j.snapshot(false))
+		}
+	}
+}
+
+// TestPause validates that a paused job sends no probes until it is resumed, that a job paused while
+// queued does not keep other jobs from running, and the status codes of pause and resume requests.
+func TestPause(t *testing.T) {
+	defaultScheduler := scheduler
+	scheduler = newJobScheduler(1, 1, 2)
+	defer func() { scheduler = defaultScheduler }()
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	req := scanRequest{ips: []string{"127.0.0.1", "127.0.0.2"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	j, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "?pause=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status pausing a queued job: %d", resp.StatusCode)
+	}
+	if status, body := doV2(t, ts, http.MethodPost, v2ScansPath+"/"+j.id+"/"+cmdPause, ""); status != http.StatusConflict {
+		t.Errorf("Unexpected response pausing a paused job, status: %d, body: %s", status, body)
+	}
+
+	// The paused job is passed over, so the next job runs to completion.
+	other, err := newJob(scanRequest{ips: []string{"127.0.0.1"}, port: "4430", settings: req.settings})
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	if scheduler.submit(j) != nil || scheduler.submit(other) != nil {
+		t.Fatalf("Error submitting jobs")
+	}
+	if sj := waitDone(t, other); sj.State != scan.JobCompleted {
+		t.Errorf("Unexpected job queued behind a paused job: %+v", sj)
+	}
+	if sj := j.snapshot(true); sj.State != scan.JobPaused || !sj.Started.IsZero() || len(sj.Results) != 0 {
+		t.Errorf("Unexpected paused job: %+v", sj)
+	}
+
+	if status, body := doV2(t, ts, http.MethodPost, v2ScansPath+"/"+j.id+"/"+cmdResume, ""); status != http.StatusOK {
+		t.Errorf("Unexpected response resuming a paused job, status: %d, body: %s", status, body)
+	}
+	if sj := waitDone(t, j); sj.State != scan.JobCompleted || len(sj.Results) != len(req.ips) {
+		t.Errorf("Unexpected resumed job: %+v", sj)
+	}
+	resp, err = http.Get(ts.URL + "?resume=" + j.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Unexpected status resuming a completed job: %d", resp.StatusCode)
+	}
+}
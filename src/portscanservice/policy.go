@@ -0,0 +1,151 @@
+package main
+
+// policy.go restricts which targets the service will scan, so the service cannot be used
+// to reach addresses on the host or the cloud provider that callers could not reach themselves.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// targetPolicy decides whether an IP may be scanned.
+type targetPolicy struct {
+	// allowed is the list of CIDRs that may be scanned; empty allows any address not denied.
+	allowed []*net.IPNet
+	// denied is the list of CIDRs that may never be scanned.
+	denied []*net.IPNet
+	// defaultDenied is the list of ranges denied unless explicitly allowed; see permitted.
+	defaultDenied []deniedRange
+}
+
+// deniedRange is a CIDR that is denied by default, with the reason reported to the caller.
+type deniedRange struct {
+	cidr   *net.IPNet
+	reason string
+}
+
+// defaultDeniedCIDRs are the loopback, link-local and cloud metadata ranges. Keys are CIDRs, values
+// are the reason reported when a target is denied.
+var defaultDeniedCIDRs = map[string]string{
+	"0.0.0.0/8":          "unspecified (this host)",
+	"127.0.0.0/8":        "loopback",
+	"::/128":             "unspecified (this host)",
+	"::1/128":            "loopback",
+	"169.254.0.0/16":     "link-local",
+	"fe80::/10":          "link-local",
+	"169.254.169.254/32": "cloud metadata",
+	"fd00:ec2::254/128":  "cloud metadata",
+	"100.100.100.200/32": "cloud metadata",
+	"168.63.129.16/32":   "cloud metadata",
+}
+
+// newTargetPolicy returns a policy allowing allowCIDRs and denying denyCIDRs, in addition to
+// defaultDeniedCIDRs. An empty allowCIDRs allows any address that is not denied.
+func newTargetPolicy(allowCIDRs []string, denyCIDRs []string) (*targetPolicy, error) {
+	tp := targetPolicy{}
+	var err error
+	if tp.allowed, err = parseCIDRs(allowCIDRs); err != nil {
+		return nil, err
+	}
+	if tp.denied, err = parseCIDRs(denyCIDRs); err != nil {
+		return nil, err
+	}
+	for k, v := range defaultDeniedCIDRs {
+		_, n, err := net.ParseCIDR(k)
+		if err != nil {
+			return nil, fmt.Errorf("parsing default denied CIDR %s, error: %+v", k, err)
+		}
+		tp.defaultDenied = append(tp.defaultDenied, deniedRange{cidr: n, reason: v})
+	}
+	return &tp, nil
+}
+
+// parseCIDRs parses a list of CIDRs; empty entries are ignored. A bare IP is accepted as a
+// single address CIDR.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	out := []*net.IPNet{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR: %s", c)
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s, error: %+v", c, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// permitted returns nil if ip (as returned by scan.ValidateIPs) may be scanned, otherwise an
+// error describing why it may not.
+// Explicitly denied CIDRs always win. When allowed CIDRs are configured, ip must be in one of them.
+// An ip in a default denied range is permitted only when an allowed CIDR at least as specific as
+// that range contains it; so allowing 127.0.0.0/8 permits loopback, but allowing 0.0.0.0/0 does not.
+func (tp *targetPolicy) permitted(ip string) error {
+	parsed := net.ParseIP(strings.Trim(ip, "[]"))
+	if parsed == nil {
+		return fmt.Errorf("target %s is not a valid IP", ip)
+	}
+
+	for _, n := range tp.denied {
+		if n.Contains(parsed) {
+			return fmt.Errorf("target %s is in denied range %s", ip, n)
+		}
+	}
+
+	if len(tp.allowed) > 0 && tp.allowedPrefix(parsed) < 0 {
+		return fmt.Errorf("target %s is not in an allowed range", ip)
+	}
+
+	for _, d := range tp.defaultDenied {
+		if !d.cidr.Contains(parsed) {
+			continue
+		}
+		ones, _ := d.cidr.Mask.Size()
+		if tp.allowedPrefix(parsed) < ones {
+			return fmt.Errorf("target %s is in %s range %s, which is denied by default", ip, d.reason, d.cidr)
+		}
+	}
+
+	return nil
+}
+
+// permittedIPs returns nil if every IP of ips may be scanned, otherwise the error of the first that
+// may not; see permitted.
+func (tp *targetPolicy) permittedIPs(ips []string) error {
+	for _, ip := range ips {
+		if err := tp.permitted(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedPrefix returns the prefix length of the most specific allowed CIDR containing ip,
+// or -1 if none does.
+func (tp *targetPolicy) allowedPrefix(ip net.IP) int {
+	longest := -1
+	for _, n := range tp.allowed {
+		if !n.Contains(ip) {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones > longest {
+			longest = ones
+		}
+	}
+	return longest
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type policyTest struct {
+	allow     []string
+	deny      []string
+	ip        string
+	permitted bool
+}
+
+// TestPolicyPermitted validates the default denied ranges and how allowed/denied CIDRs interact.
+func TestPolicyPermitted(t *testing.T) {
+	tests := []policyTest{
+		{nil, nil, "8.8.8.8", true},
+		{nil, nil, "127.0.0.1", false},
+		{nil, nil, "0.0.0.0", false},
+		{nil, nil, "[::1]", false},
+		{nil, nil, "169.254.169.254", false},
+		{nil, nil, "[fe80::1]", false},
+		{nil, []string{"8.8.0.0/16"}, "8.8.8.8", false},
+		{[]string{"10.0.0.0/8"}, nil, "8.8.8.8", false},
+		{[]string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{[]string{"0.0.0.0/0"}, nil, "127.0.0.1", false},
+		{[]string{"127.0.0.0/8"}, nil, "127.0.0.1", true},
+		{[]string{"127.0.0.1"}, []string{"127.0.0.1"}, "127.0.0.1", false},
+		{[]string{"169.254.0.0/16"}, nil, "169.254.1.1", true},
+		{[]string{"169.254.0.0/16"}, nil, "169.254.169.254", false},
+	}
+	for _, v := range tests {
+		tp, err := newTargetPolicy(v.allow, v.deny)
+		if err != nil {
+			t.Errorf("Error creating policy: %+v", err)
+			continue
+		}
+		err = tp.permitted(v.ip)
+		if (err == nil) != v.permitted {
+			t.Errorf("Unexpected policy result for %+v, error: %+v", v, err)
+		}
+	}
+
+	if _, err := newTargetPolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Errorf("Invalid CIDR was accepted!")
+	}
+}
+
+// TestPolicyForbidden validates that denied targets are rejected by the API with 403.
+func TestPolicyForbidden(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "?setips=8.8.8.8,169.254.169.254&setport=80")
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status for denied target: %d", resp.StatusCode)
+	}
+}
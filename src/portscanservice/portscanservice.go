@@ -5,52 +5,208 @@
 // Retrieve results with a query key 'results', and value of the ID returned from starting the scan.
 // Results can be retrieved at any time after starting a scan, though a result may be
 // incomplete until the timeout.
-// To prevent memory growth in the event of unread results, resutls are kept in a queue
-// and old results removed. Results may also only be read once, as the result is deleted
-// when it is read.
-// Query string keys: results, setips, setport
+// Retrieve the state (queued, running, completed, failed or cancelled) and progress of a scan,
+// including an estimated finish time, with a query key 'status' and value of the ID returned from
+// starting the scan. Requesting the results of a scan that is not done returns the results collected
+// so far, with status 202 Accepted and the X-Portscan-Partial and X-Portscan-Percent headers set;
+// Reading results does not remove them. To prevent memory growth, results are removed when their
+// TTL expires (the resultsttl flag, or the optional query key 'setttl' when starting the scan), or,
+// oldest first, when the results of all done scans exceed the resultsmaxbytes flag. Remove results
+// explicitly with a query key 'delete' and value of the ID.
+// Scans are kept in memory, or, with the storedir flag, also in a directory, so scans and their
+// results are available by ID after a restart. Scans that were not done when the service stopped
+// are resumed, probing only the targets without a result as of the last save (the
+// checkpointinterval flag).
+// Cancel a scan that is not done with a query key 'cancel' and value of the ID. No further probes
+// are sent; the results collected so far are kept, and the scan moves to the cancelled state once
+// probes in flight complete.
+// Pause a queued or running scan with a query key 'pause' and value of the ID, and resume it with a
+// query key 'resume'. While paused no further probes are sent, and the scan keeps its results and
+// place; a budget continues to run while paused.
+// The optional query key 'setbudget' limits the time for the whole scan, as a duration (I.E. 5m)
+// or integer seconds; targets not probed within the budget are returned as not scanned.
+// The optional query key 'setprofile' selects a named scan profile (I.E. gentle, normal,
+// aggressive-lan, or a profile from the file given with the profiles flag) that sets threads,
+// timeout, retries and rate.
+// The optional query keys 'setthreads', 'settimeout' (a duration or integer seconds), 'setretries'
+// and 'setrate' override a single setting of the profile, within the limits given with the
+// maxthreads, mintimeout, maxtimeout, maxretries and maxrate flags; others are rejected with
+// status 403 Forbidden.
+// The optional query key 'setrdns' (on/off) adds hostnames from reverse DNS lookups to the results
+// of targets that responded, using the resolver given with the resolver flag.
+// The optional query key 'setpriority' (interactive/batch) sets the priority of the scan; queued
+// interactive scans run before batch scans, and get more of the shared workers. By default, scans of
+// up to interactivetargets targets are interactive, and larger scans are batch.
+// Retrieve a summary of the results (counts per state, open ports per host, top open ports, error
+// categories, duration and rate) with a query key 'summary' and value of the ID.
+// Query string keys: cancel, delete, pause, results, resume, setbudget, setips, setport, setpriority, setprofile, setrate,
+// setrdns, setretries, setthreads, settimeout, setttl, status, summary
+// Targets are checked against a policy; loopback, link-local and cloud metadata ranges are
+// denied by default, and scans can be restricted to allowed CIDRs with the allowcidrs flag.
 // Examples: (change 127.0.0.1 to the service IP when not running on the same host):
 // curl http://127.0.0.1%s/?setips=8.8.8.8,9.9.9.9&setport=443
+// curl http://127.0.0.1%s/?setips=8.8.8.8,9.9.9.9&setport=443&setprofile=gentle&settimeout=10s
 // curl http://127.0.0.1%s/?results=SOME_ID
+// curl http://127.0.0.1%s/?results=SOME_ID&format=ndjson
+// curl http://127.0.0.1%s/?status=SOME_ID
+// curl http://127.0.0.1%s/?summary=SOME_ID
+// curl http://127.0.0.1%s/?cancel=SOME_ID
+// curl http://127.0.0.1%s/?pause=SOME_ID
+// curl http://127.0.0.1%s/?resume=SOME_ID
+// curl http://127.0.0.1%s/?delete=SOME_ID
+// A ReSTful v2 API, using JSON request and response bodies, is also provided; see apiv2.go. The v2
+// API also manages schedules of recurring scans; see apiv2schedules.go.
+// Connection attempts of all scans share a pool of workers (the workers flag), granted to scans in
+// turn. At most maxrunning scans run at once, and at most maxqueued wait to run; further requests
+// are rejected with status 429 Too Many Requests. Queued scans of the same priority run fairly
+// between submitters (by client IP); the status of a queued scan includes its queue position.
+// Scans and schedules created with the v2 API may give a webhook URL, which is sent an event when
+// each scan is done; see webhooks.go.
+// On SIGTERM or SIGINT the service stops accepting scans, and gives running scans the shutdowngrace
+// period to finish before stopping and saving them and exiting; see shutdown.go.
 
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"runtime/debug"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/paulfdunn/portscan/src/scan"
 )
 
 const (
-	// HTTPPort is the port that this service is listening on for API requests.
-	// TODO: Make this an input.
-	HTTPPort = ":" + scan.DefaultServicePort
-
-	// threads could be a user input, if desired; easy change.
-	threads = 10
-
-	cmdResults = "results"
-	cmdSetips  = "setips"
-	cmdSetport = "setport"
-
-	resultsQueueSize = 30
+	// writeTimeout limits the time to handle a request, other than streaming requests.
+	writeTimeout = 10 * time.Second
+
+	cmdCancel      = "cancel"
+	cmdDelete      = "delete"
+	cmdFormat      = "format"
+	cmdPause       = "pause"
+	cmdResume      = "resume"
+	cmdResults     = "results"
+	cmdSetbudget   = "setbudget"
+	cmdSetips      = "setips"
+	cmdSetport     = "setport"
+	cmdSetpriority = "setpriority"
+	cmdSetprofile  = "setprofile"
+	cmdSetrate     = "setrate"
+	cmdSetrdns     = "setrdns"
+	cmdSetretries  = "setretries"
+	cmdSetthreads  = "setthreads"
+	cmdSettimeout  = "settimeout"
+	cmdSetttl      = "setttl"
+	cmdStatus      = "status"
+	cmdSummary     = "summary"
 )
 
 var (
-	// timeout is timeout for scan requests
-	// TODO: Make this an input.
-	timeoutSeconds = 2
-	timeout        = time.Duration(timeoutSeconds) * time.Second
+	// HTTPPort is the port that this service is listening on for API requests, from the httpport
+	// flag.
+	HTTPPort = ":" + scan.DefaultServicePort
+	httpPort = flag.String("httpport", scan.DefaultServicePort,
+		"Port that the service listens on for API requests.")
+
+	threads = flag.Int("threads", scan.Profiles[scan.DefaultProfile].Threads,
+		"Threads of scans that do not request a profile.")
+	timeout = flag.Duration("timeout", scan.Profiles[scan.DefaultProfile].Timeout,
+		"Connect timeout of scans that do not request a profile.")
+
+	configFile = flag.String(configFlag, "",
+		"JSON file of config; see config.go. Flags and PORTSCAN_* environment variables take precedence.")
+	dumpConfigOnly = flag.Bool(dumpConfigFlag, false,
+		"Print the effective config, as JSON, and exit.")
+
+	// help is the help text returned with errors of the query string API.
+	help = helpText()
+
+	allowCIDRs = flag.String("allowcidrs", "",
+		"CSV list of CIDRs that may be scanned. Default is any address that is not denied. "+
+			"Loopback, link-local and cloud metadata ranges are only allowed when listed explicitly.")
+	denyCIDRs = flag.String("denycidrs", "",
+		"CSV list of CIDRs that may not be scanned, in addition to the loopback, link-local "+
+			"and cloud metadata ranges denied by default.")
+	// policy restricts the targets that may be scanned.
+	policy *targetPolicy
+
+	profilesFile = flag.String("profiles", "",
+		"JSON file of user defined scan profiles, in addition to the built in profiles.")
+	// profiles are the scan profiles that may be requested with the setprofile query key.
+	profiles = scan.Profiles
+
+	maxThreads = flag.Int("maxthreads", 100,
+		"Maximum threads a scan request may set with setthreads.")
+	minTimeout = flag.Duration("mintimeout", 100*time.Millisecond,
+		"Minimum connect timeout a scan request may set with settimeout.")
+	maxTimeout = flag.Duration("maxtimeout", 30*time.Second,
+		"Maximum connect timeout a scan request may set with settimeout.")
+	maxRetries = flag.Int("maxretries", 5,
+		"Maximum retries a scan request may set with setretries.")
+	maxRate = flag.Float64("maxrate", 0,
+		"Maximum rate, in probes per second, a scan request may set with setrate. Default is no limit.")
+
+	resolverAddress = flag.String("resolver", "",
+		"DNS server (host or host:port) for reverse lookups. Default is the system resolver.")
+	rdnsConcurrency = flag.Int("rdnsconcurrency", scan.DefaultLookupConcurrency,
+		"Maximum number of concurrent reverse lookups per scan.")
+	// resolver is used for reverse lookups requested with the setrdns query key.
+	resolver = net.DefaultResolver
+
+	resultsTTL = flag.Duration("resultsttl", 24*time.Hour,
+		"Time that a scan and its results are kept after the scan is done, unless the request specifies a TTL.")
+	resultsMaxTTL = flag.Duration("resultsmaxttl", 7*24*time.Hour,
+		"Maximum TTL that a request may specify.")
+	resultsMaxBytes = flag.Int("resultsmaxbytes", 64<<20,
+		"Maximum estimated size, in bytes, of the results of all done scans. The oldest are removed first.")
+	storeDir = flag.String("storedir", "",
+		"Directory in which scans, their requests and results are stored, so they survive a restart. "+
+			"Default is to keep scans only in memory.")
+	checkpointInterval = flag.Duration("checkpointinterval", 10*time.Second,
+		"Interval at which running scans are saved, so they resume from the last save after a restart.")
+	shutdownGrace = flag.Duration("shutdowngrace", 20*time.Second,
+		"Time, after SIGTERM or SIGINT, that running scans are given to finish before they are saved and the "+
+			"service exits.")
+	// jobs holds all jobs, by ID, until they are removed.
+	jobs *jobStore
+
+	workers = flag.Int("workers", 100,
+		"Number of connection attempts in flight across all scans; workers are shared by running scans in turn.")
+	maxRunning = flag.Int("maxrunning", 10,
+		"Maximum number of scans running at once.")
+	maxQueued = flag.Int("maxqueued", 100,
+		"Maximum number of scans waiting to run; further requests are rejected with status 429.")
+	interactiveTargets = flag.Int("interactivetargets", 256,
+		"Maximum number of targets of a scan that is interactive when the request does not specify a priority; "+
+			"larger scans are batch.")
+	// scheduler runs jobs within the limits above.
+	scheduler *jobScheduler
+	// schedules holds the schedules of recurring scans, by ID.
+	schedules *scheduleStore
+
+	webhookSecret = flag.String("webhooksecret", "",
+		"Secret used to sign webhook deliveries with HMAC-SHA256, in the "+scan.SignatureHeader+" header. "+
+			"Default is to send deliveries unsigned.")
+	webhookRetries = flag.Int("webhookretries", 5,
+		"Number of times a failed webhook delivery is retried, with exponential backoff.")
+
+	allowOrigin = flag.String("alloworigin", "",
+		"Origin (I.E. https://dashboard.example.com, or * for any) allowed to read the event streams of "+
+			"scans from a browser, using CORS. Default allows none.")
+)
 
-	help = []byte(
+// helpText returns the help text, with examples using HTTPPort.
+func helpText() []byte {
+	return []byte(
 		"\n" +
 			"portscanservice is a service for port scanning using a ReST API. " +
 			"project home: https://github.com/paulfdunn/portscan\n" +
@@ -59,19 +215,77 @@ var (
 			"Retrieve results with a query key 'results', and value of the ID returned from starting the scan.\n" +
 			"Results can be retrieved at any time after starting a scan, though all results may not be " +
 			"available until the timeout.\n" +
-			"Query string keys: results, setips, setport\n" +
+			"Retrieve the state and progress of a scan with a query key 'status', and value of the ID returned " +
+			"from starting the scan. Requesting the results of a scan that is not done returns the results collected " +
+			"so far, with status 202 Accepted and the headers " + scan.PartialHeader + " and " + scan.PercentHeader + ".\n" +
+			"The optional query key 'setbudget' limits the time for the whole scan, as a duration (I.E. 5m) " +
+			"or integer seconds; targets not probed within the budget are returned as not scanned.\n" +
+			"The optional query key 'setprofile' selects a named scan profile that sets threads, timeout, " +
+			"retries and rate; profiles: " + strings.Join(scan.ProfileNames(scan.Profiles), ", ") + ", " +
+			"and those in the file given with the profiles flag.\n" +
+			"The optional query keys 'setthreads', 'settimeout' (a duration or integer seconds), 'setretries' " +
+			"and 'setrate' (probes per second) override a single setting of the profile; values outside the " +
+			"limits set by the operator are rejected with status 403 Forbidden.\n" +
+			"The optional query key 'setrdns' (on/off) adds hostnames from reverse DNS lookups to the results " +
+			"of targets that responded.\n" +
+			"The optional query key 'setpriority' (interactive/batch) sets the priority of the scan; queued " +
+			"interactive scans run before batch scans. " +
+			fmt.Sprintf("By default, scans of up to %d targets are interactive, and larger scans are batch.\n", *interactiveTargets) +
+			"Retrieve a summary of the results, with counts per state, open ports per host, top open ports, " +
+			"error categories, duration and rate, with a query key 'summary', and value of the ID.\n" +
+			"Reading results does not remove them. Results are removed when their TTL expires (the optional " +
+			"query key 'setttl' sets the TTL, as a duration or integer seconds), or, oldest first, when the " +
+			"results of all done scans exceed the service limit. Remove results with a query key 'delete', and " +
+			"value of the ID.\n" +
+			"Cancel a scan that is not done with a query key 'cancel', and value of the ID; results collected " +
+			"so far are kept.\n" +
+			"Pause a queued or running scan with a query key 'pause', and resume it with a query key 'resume', " +
+			"with value of the ID. No probes are sent while paused.\n" +
+			"Query string keys: cancel, delete, pause, results, resume, setbudget, setips, setport, setpriority, " +
+			"setprofile, setrate, setrdns, setretries, setthreads, settimeout, setttl, status, summary\n" +
+			"Targets in loopback, link-local and cloud metadata ranges, or outside the ranges " +
+			"allowed by the operator, are rejected with status 403 Forbidden.\n" +
+			"Scans wait to run when the service is busy; when too many are waiting, requests are rejected " +
+			"with status 429 Too Many Requests, and should be retried later. The status of a queued scan " +
+			"includes its position in the queue. While the service is shutting down, requests to start a scan " +
+			"are rejected with status 503 Service Unavailable.\n" +
 			"Examples: (change 127.0.0.1 to the service IP when not running on the same host):\n" +
 			fmt.Sprintf("curl http://127.0.0.1%s/?setips=8.8.8.8,9.9.9.9&setport=443\n", HTTPPort) +
-			fmt.Sprintf("curl http://127.0.0.1%s/?results=SOME_ID\n", HTTPPort))
-
-	resultsMap     map[string]scan.Results
-	resultsMapLock sync.RWMutex
-	resultsQueue   chan string
-)
+			fmt.Sprintf("curl http://127.0.0.1%s/?setips=8.8.8.8,9.9.9.9&setport=443&setprofile=gentle&settimeout=10s\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?results=SOME_ID\n", HTTPPort) +
+			"Add format=ndjson to results to get one JSON result per line, written as it is read.\n" +
+			"Filter results with the keys state (I.E. open), ip (IPs or CIDRs), port and service (I.E. ssh), " +
+			"sort them with sort (ip, port or state; -ip for descending), and page them with limit; the " +
+			"next page is requested with cursor set to the " + scan.CursorHeader + " header.\n" +
+			fmt.Sprintf("curl http://127.0.0.1%s/?results=SOME_ID&state=open&ip=10.0.0.0/24&sort=port&limit=100\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?results=SOME_ID&format=ndjson\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?status=SOME_ID\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?summary=SOME_ID\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?cancel=SOME_ID\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?pause=SOME_ID\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?resume=SOME_ID\n", HTTPPort) +
+			fmt.Sprintf("curl http://127.0.0.1%s/?delete=SOME_ID\n", HTTPPort) +
+			"A ReSTful v2 API is also available: POST /v2/scans with a JSON body to start a scan, " +
+			"GET /v2/scans to list scans, GET /v2/scans/SOME_ID for status and results, " +
+			"DELETE /v2/scans/SOME_ID to delete a scan, and POST /v2/scans/SOME_ID/cancel, /pause or /resume " +
+			"to cancel, pause or resume a scan. GET /v2/scans/SOME_ID/events streams progress and results as " +
+			"Server-Sent Events, and GET /v2/scans/SOME_ID/summary summarizes the results. GET /v2/scans/SOME_ID/diff?from=OTHER_ID shows ports that " +
+			"changed state between two scans. Recurring scans are managed with POST /v2/schedules, GET " +
+			"/v2/schedules, GET and DELETE /v2/schedules/SOME_ID, and POST /v2/schedules/SOME_ID/pause or /resume; GET /v2/schedules/SOME_ID/diff compares the last two runs.\n" +
+			fmt.Sprintf("curl -X POST -d '{\"IPs\":[\"8.8.8.8\"],\"Port\":\"443\"}' http://127.0.0.1%s/v2/scans\n", HTTPPort))
+}
 
 func init() {
-	resultsMap = make(map[string]scan.Results)
-	resultsQueue = make(chan string, resultsQueueSize)
+	backend := nopBackend{}
+	jobs = newJobStore(*resultsMaxBytes, *resultsTTL, backend)
+	scheduler = newJobScheduler(*workers, *maxRunning, *maxQueued)
+	schedules = newScheduleStore(backend)
+
+	var err error
+	policy, err = newTargetPolicy(nil, nil)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func main() {
@@ -81,20 +295,142 @@ func main() {
 		}
 	}()
 
-	http.Handle("/", http.HandlerFunc(handlerIndex))
+	flag.Parse()
+	if err := loadConfig(flag.CommandLine, os.Getenv); err != nil {
+		fmt.Printf("ERROR: loading config, error: %+v\n", err)
+		return
+	}
+	if *dumpConfigOnly {
+		b, err := dumpConfig(flag.CommandLine)
+		if err != nil {
+			fmt.Printf("ERROR: dumping config, error: %+v\n", err)
+			return
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+	port, err := scan.ValidatePort(*httpPort)
+	if err != nil {
+		fmt.Printf("ERROR: invalid httpport %s, error: %+v\n", *httpPort, err)
+		return
+	}
+	HTTPPort, help = ":"+port, helpText()
+	if *threads < 1 || *timeout <= 0 || *shutdownGrace < 0 {
+		fmt.Printf("ERROR: threads must be >= 1, timeout > 0, and shutdowngrace >= 0\n")
+		return
+	}
+
+	policy, err = newTargetPolicy(strings.Split(*allowCIDRs, ","), strings.Split(*denyCIDRs, ","))
+	if err != nil {
+		fmt.Printf("ERROR: creating target policy, error: %+v\n", err)
+		return
+	}
+	profiles, err = scan.LoadProfiles(*profilesFile)
+	if err != nil {
+		fmt.Printf("ERROR: loading profiles, error: %+v\n", err)
+		return
+	}
+	resolver, err = scan.NewResolver(*resolverAddress)
+	if err != nil {
+		fmt.Printf("ERROR: creating resolver, error: %+v\n", err)
+		return
+	}
+
+	if *workers < 1 || *maxRunning < 1 || *maxQueued < 0 || *interactiveTargets < 0 {
+		fmt.Printf("ERROR: workers and maxrunning must be >= 1, and maxqueued and interactivetargets >= 0\n")
+		return
+	}
+	if *maxThreads < 1 || *minTimeout <= 0 || *maxTimeout < *minTimeout || *maxRetries < 0 || *maxRate < 0 {
+		fmt.Printf("ERROR: maxthreads must be >= 1, mintimeout > 0, maxtimeout >= mintimeout, and maxretries " +
+			"and maxrate >= 0\n")
+		return
+	}
+
+	var backend jobBackend = nopBackend{}
+	if *storeDir != "" {
+		if backend, err = newFileBackend(*storeDir); err != nil {
+			fmt.Printf("ERROR: creating store, error: %+v\n", err)
+			return
+		}
+	}
+	jobs = newJobStore(*resultsMaxBytes, *resultsTTL, backend)
+	scheduler = newJobScheduler(*workers, *maxRunning, *maxQueued)
+	interrupted, err := jobs.restore()
+	if err != nil {
+		fmt.Printf("ERROR: restoring scans, error: %+v\n", err)
+		return
+	}
+	for _, j := range interrupted {
+		resumeJob(j)
+	}
+	go jobs.expireEvery(time.Minute)
+	schedules = newScheduleStore(backend)
+	if err := schedules.restore(); err != nil {
+		fmt.Printf("ERROR: restoring schedules, error: %+v\n", err)
+		return
+	}
+	go schedules.runEvery(time.Second)
 
 	fmt.Printf("INFO: %s starting HTTP server.\n", scan.ServiceAppName)
 	httpServer := http.Server{
 		Addr:           HTTPPort,
-		Handler:        nil,
+		Handler:        newServeMux(),
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 16,
 	}
-	fmt.Println(httpServer.ListenAndServe())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.ListenAndServe() }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		fmt.Println(err)
+	case sig := <-signals:
+		fmt.Printf("INFO: received %s.\n", sig)
+		go func() {
+			sig := <-signals
+			fmt.Printf("WARNING: received %s during shutdown; exiting now, scans that are not done are lost.\n", sig)
+			os.Exit(1)
+		}()
+		shutdown(&httpServer, *shutdownGrace)
+	}
+}
+
+// newServeMux returns the handler for the query string API and the v2 API.
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", withWriteTimeout(http.HandlerFunc(handlerIndex)))
+	mux.Handle(v2ScansPath, withWriteTimeout(http.HandlerFunc(handlerV2Scans)))
+	mux.Handle(v2ScansPath+"/", withWriteTimeout(http.HandlerFunc(handlerV2Scans)))
+	mux.Handle(v2SchedulesPath, withWriteTimeout(http.HandlerFunc(handlerV2Schedules)))
+	mux.Handle(v2SchedulesPath+"/", withWriteTimeout(http.HandlerFunc(handlerV2Schedules)))
+	return mux
 }
 
-// handlerIndex handles all ReST API requests.
+// withWriteTimeout returns h, failing requests that are not handled within writeTimeout with
+// status 503. The server has no write timeout, so that streaming responses, see isStreaming, may
+// run as long as needed; they are passed to h without a timeout.
+func withWriteTimeout(h http.Handler) http.Handler {
+	th := http.TimeoutHandler(h, writeTimeout, `{"Error":"request timed out"}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreaming(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		th.ServeHTTP(w, r)
+	})
+}
+
+// isStreaming returns true for requests with streaming responses, which are written until done:
+// event streams and NDJSON results.
+func isStreaming(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, v2ScansPath+"/") && strings.HasSuffix(r.URL.Path, "/"+v2Events) {
+		return true
+	}
+	return isNDJSON(r)
+}
+
+// handlerIndex handles all query string API requests.
 func handlerIndex(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -107,35 +443,49 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 	// Always let callers know the responding app.
 	w.Header().Set(scan.ServiceHeader, scan.ServiceAppName)
 
-	ips, port, cmd, results, err := queryValidateAndParse(w, r)
+	req, cmd, out, err := queryValidateAndParse(w, r)
 	if err != nil {
 		return
 	}
-	// fmt.Printf("Debug: %s, %s, %s, %+v, %+v\n", ips, port, cmd, results, err)
+	// fmt.Printf("Debug: %+v, %s, %+v, %+v\n", req, cmd, out, err)
 
-	if cmd == cmdResults {
-		b, err := json.Marshal(results)
+	if results, ok := out.(ndjsonResults); ok {
+		fmt.Printf("%s: %d results as %s\n", cmd, len(results), formatNDJSON)
+		status := http.StatusOK
+		if w.Header().Get(scan.PartialHeader) == "true" {
+			status = http.StatusAccepted
+		}
+		writeNDJSON(w, status, scan.Results(results))
+		return
+	}
+	if cmd != "" {
+		b, err := json.Marshal(out)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, fmt.Sprintf("%+v", fmt.Sprintf("ERROR: %+v", err)))
 			return
 		}
 
-		fmt.Printf("%s: %+v", cmdResults, results)
-		w.WriteHeader(http.StatusOK)
+		fmt.Printf("%s: %+v", cmd, out)
+		status := http.StatusOK
+		if w.Header().Get(scan.PartialHeader) == "true" || cmd == cmdCancel {
+			status = http.StatusAccepted
+		}
+		w.WriteHeader(status)
 		w.Write(b)
 		return
 	}
 
-	id, err := uniqueID()
-	if err != nil {
+	id, err := startScan(req)
+	if err == errQueueFull {
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("ERROR: %+v\n", err))
+		return
+	} else if err == errShuttingDown {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("ERROR: %+v\n", err))
+		return
+	} else if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("%+v", fmt.Sprintf("ERROR: %+v", err)))
 		return
 	}
-	go func(idin string) {
-		rslts := scan.Scan(port, ips, threads, timeout)
-		resultsQueue <- idin
-		addResultRemoveOldest(idin, rslts)
-	}(id)
 	b, err := json.Marshal(scan.ID{ID: id})
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("%+v", fmt.Sprintf("ERROR: %+v", err)))
@@ -145,101 +495,421 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-// queryValidateAndParse validates the query string and returns the pertinent output.
-func queryValidateAndParse(w http.ResponseWriter, r *http.Request) (ips []string,
-	port string, cmd string, results scan.Results, err error) {
+// scanRequest is a validated request to start a scan.
+type scanRequest struct {
+	ips  []string
+	port string
+	// budget is the time limit for the whole scan; zero for no limit.
+	budget   time.Duration
+	settings scan.Settings
+	// rdns adds hostnames to the results from reverse lookups.
+	rdns bool
+	// ttl is the time the job is kept once done; zero for the store default.
+	ttl time.Duration
+	// priority is one of the scan.Priority* priorities.
+	priority string
+	// submitter identifies the client requesting the scan, for fair scheduling.
+	submitter string
+	// scheduleID is the ID of the schedule that started the scan, if any.
+	scheduleID string
+	// webhook is the URL sent an event when the scan is done, if any.
+	webhook string
+}
+
+// jobActions are the query keys, and v2 API actions, that change the state of a job. Each returns
+// false if the state of the job does not allow the action.
+var jobActions = map[string]func(*job) bool{
+	cmdCancel: (*job).requestCancel,
+	cmdPause:  (*job).pause,
+	cmdResume: (*job).unpause,
+}
+
+// jobActionStates are the past tense of jobActions, for errors.
+var jobActionStates = map[string]string{cmdCancel: "cancelled", cmdPause: "paused", cmdResume: "resumed"}
+
+// startScan submits an asynchronous scan job to the scheduler and returns its ID. Returns
+// errQueueFull if the service is at capacity, or errShuttingDown if it is shutting down.
+func startScan(req scanRequest) (string, error) {
+	j, err := newJob(req)
+	if err != nil {
+		return "", err
+	}
+	if err := scheduler.submit(j); err != nil {
+		jobs.delete(j.id)
+		return "", err
+	}
+	return j.id, nil
+}
+
+// queryValidateAndParse validates the query string and returns the pertinent output. For
+// the results, status, summary, delete, cancel, pause and resume commands, out is the scan.Results,
+// scan.Job, scan.Summary or scan.ID to return. For the
+// results and summary commands of a job that is not done, the partial headers are set on w.
+func queryValidateAndParse(w http.ResponseWriter, r *http.Request) (req scanRequest,
+	cmd string, out interface{}, err error) {
 	// Make query parameters case insensitive.
 	u, err := url.Parse(strings.ToLower(r.RequestURI))
 	if err != nil {
 		msg := fmt.Sprintf("ERROR:parsing URL, error: %+v\n\n%s", err, help)
 		writeError(w, http.StatusBadRequest, msg)
-		return nil, "", "", nil, err
+		return scanRequest{}, "", nil, err
 	}
 
 	qs := u.Query()
 	ipsUser, ipsCmd := qs[cmdSetips]
 	portUser, portCmd := qs[cmdSetport]
 	resultsUser, resultsCmd := qs[cmdResults]
-
-	if resultsCmd && (ipsCmd || portCmd) {
-		err := fmt.Errorf("results must be requested separately from setting IPs and port")
+	statusUser, statusCmd := qs[cmdStatus]
+	summaryUser, summaryCmd := qs[cmdSummary]
+	budgetUser, budgetCmd := qs[cmdSetbudget]
+	profileUser, profileCmd := qs[cmdSetprofile]
+	rdnsUser, rdnsCmd := qs[cmdSetrdns]
+	priorityUser, priorityCmd := qs[cmdSetpriority]
+	ttlUser, ttlCmd := qs[cmdSetttl]
+	deleteUser, deleteCmd := qs[cmdDelete]
+	_, cancelCmd := qs[cmdCancel]
+	_, pauseCmd := qs[cmdPause]
+	_, resumeCmd := qs[cmdResume]
+
+	idCmds := 0
+	for _, c := range []bool{resultsCmd, statusCmd, summaryCmd, deleteCmd, cancelCmd, pauseCmd, resumeCmd} {
+		if c {
+			idCmds++
+		}
+	}
+	settingsCmd := false
+	for _, k := range settingsKeys {
+		if _, ok := qs[k]; ok {
+			settingsCmd = true
+		}
+	}
+	if idCmds > 1 || (idCmds == 1 && (ipsCmd || portCmd || budgetCmd || profileCmd || settingsCmd || rdnsCmd || ttlCmd || priorityCmd)) {
+		err := fmt.Errorf("results, status, summary, delete, cancel, pause and resume must each be requested alone, separately from " +
+			"setting IPs, port, budget, profile, threads, timeout, retries, rate, rdns, ttl and priority")
 		msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
 		writeError(w, http.StatusBadRequest, msg)
-		return nil, "", "", nil, err
-	} else if !resultsCmd && !(ipsCmd && portCmd) {
-		err := fmt.Errorf("the query must include ONLY the key '%s', or BOTH keys '%s' and '%s'",
-			cmdResults, cmdSetips, cmdSetport)
+		return scanRequest{}, "", nil, err
+	} else if idCmds == 0 && !(ipsCmd && portCmd) {
+		err := fmt.Errorf("the query must include ONLY one of the keys '%s', '%s', '%s', '%s', '%s', '%s' or '%s', "+
+			"or BOTH keys '%s' and '%s'", cmdResults, cmdStatus, cmdSummary, cmdDelete, cmdCancel, cmdPause, cmdResume, cmdSetips, cmdSetport)
 		msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
 		writeError(w, http.StatusBadRequest, msg)
-		return nil, "", "", nil, err
+		return scanRequest{}, "", nil, err
+	}
+
+	for _, k := range resultsKeys {
+		if _, ok := qs[k]; ok && !resultsCmd {
+			err := fmt.Errorf("%s may only be requested with results", k)
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
 	}
 
 	if resultsCmd {
+		format, err := validateFormat(qs.Get(cmdFormat))
+		var q resultsQuery
+		if err == nil {
+			q, err = parseResultsQuery(qs)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
 		if len(resultsUser) != 1 {
 			err := fmt.Errorf("only one result can be requested at a time, received: %+v", resultsUser)
 			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
 			writeError(w, http.StatusBadRequest, msg)
-			return nil, "", "", nil, err
+			return scanRequest{}, "", nil, err
+		}
+
+		if j, ok := jobs.get(resultsUser[0]); ok {
+			sj := j.snapshot(true)
+			if sj.Partial {
+				w.Header().Set(scan.PartialHeader, "true")
+				w.Header().Set(scan.PercentHeader, fmt.Sprintf("%.1f", sj.Percent))
+			}
+			results, next := q.apply(sj.Results)
+			if next != "" {
+				w.Header().Set(scan.CursorHeader, next)
+			}
+			if format == formatNDJSON {
+				return scanRequest{}, cmdResults, ndjsonResults(results), nil
+			}
+			return scanRequest{}, cmdResults, results, nil
+		}
+
+		err = fmt.Errorf("ID %s was not a recognized ID", resultsUser[0])
+		msg := fmt.Sprintf("ERROR: %+v\n", err)
+		writeError(w, http.StatusBadRequest, msg)
+		return scanRequest{}, "", nil, err
+	}
+
+	if statusCmd {
+		if len(statusUser) != 1 {
+			err := fmt.Errorf("only one status can be requested at a time, received: %+v", statusUser)
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
 		}
 
-		resultsMapLock.RLock()
-		v, ok := resultsMap[resultsUser[0]]
-		delete(resultsMap, resultsUser[0])
-		resultsMapLock.RUnlock()
-		if ok {
-			return nil, "", cmdResults, v, nil
+		if j, ok := jobs.get(statusUser[0]); ok {
+			return scanRequest{}, cmdStatus, j.snapshot(false), nil
 		}
 
-		err := fmt.Errorf("ID %s was not a recognized ID", resultsUser[0])
+		err := fmt.Errorf("ID %s was not a recognized ID", statusUser[0])
 		msg := fmt.Sprintf("ERROR: %+v\n", err)
 		writeError(w, http.StatusBadRequest, msg)
-		return nil, "", "", nil, err
+		return scanRequest{}, "", nil, err
+	}
+
+	if summaryCmd {
+		if len(summaryUser) != 1 {
+			err := fmt.Errorf("only one summary can be requested at a time, received: %+v", summaryUser)
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
+
+		if j, ok := jobs.get(summaryUser[0]); ok {
+			return scanRequest{}, cmdSummary, summarize(w, j.snapshot(true)), nil
+		}
+
+		err := fmt.Errorf("ID %s was not a recognized ID", summaryUser[0])
+		msg := fmt.Sprintf("ERROR: %+v\n", err)
+		writeError(w, http.StatusBadRequest, msg)
+		return scanRequest{}, "", nil, err
+	}
+
+	if deleteCmd {
+		if len(deleteUser) != 1 {
+			err := fmt.Errorf("only one delete can be requested at a time, received: %+v", deleteUser)
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
+
+		j, ok := jobs.get(deleteUser[0])
+		if !ok {
+			err := fmt.Errorf("ID %s was not a recognized ID", deleteUser[0])
+			msg := fmt.Sprintf("ERROR: %+v\n", err)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
+		if sj := j.snapshot(false); !sj.Done() {
+			err := fmt.Errorf("ID %s is %s; it can be deleted once it is done", sj.ID, sj.State)
+			msg := fmt.Sprintf("ERROR: %+v\n", err)
+			writeError(w, http.StatusConflict, msg)
+			return scanRequest{}, "", nil, err
+		}
+		jobs.delete(deleteUser[0])
+		return scanRequest{}, cmdDelete, scan.ID{ID: deleteUser[0]}, nil
 	}
 
-	if portCmd {
-		if len(portUser) != 1 {
-			err := fmt.Errorf("%s", scan.InvalidPort)
+	for cmd, action := range jobActions {
+		actionUser, ok := qs[cmd]
+		if !ok {
+			continue
+		}
+		if len(actionUser) != 1 {
+			err := fmt.Errorf("only one %s can be requested at a time, received: %+v", cmd, actionUser)
+			msg := fmt.Sprintf("ERROR: %+v\n\n%s", err, help)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
+
+		j, ok := jobs.get(actionUser[0])
+		if !ok {
+			err := fmt.Errorf("ID %s was not a recognized ID", actionUser[0])
+			msg := fmt.Sprintf("ERROR: %+v\n", err)
+			writeError(w, http.StatusBadRequest, msg)
+			return scanRequest{}, "", nil, err
+		}
+		if !action(j) {
+			err := fmt.Errorf("ID %s is %s, and cannot be %s", actionUser[0], j.snapshot(false).State, jobActionStates[cmd])
+			msg := fmt.Sprintf("ERROR: %+v\n", err)
+			writeError(w, http.StatusConflict, msg)
+			return scanRequest{}, "", nil, err
+		}
+		return scanRequest{}, cmd, j.snapshot(false), nil
+	}
+
+	sr := scan.Request{}
+	for i := range ipsUser {
+		sr.IPs = append(sr.IPs, strings.Split(ipsUser[i], ",")...)
+	}
+	if len(portUser) != 1 {
+		err := fmt.Errorf("%s", scan.InvalidPort)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+		return scanRequest{}, "", nil, err
+	}
+	sr.Port = portUser[0]
+	if budgetCmd {
+		if len(budgetUser) != 1 {
+			err := fmt.Errorf("%s", scan.InvalidBudget)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+			return scanRequest{}, "", nil, err
+		}
+		sr.Budget = budgetUser[0]
+	}
+	if profileCmd {
+		if len(profileUser) != 1 {
+			err := fmt.Errorf("%s%+v", scan.InvalidProfile, scan.ProfileNames(profiles))
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+			return scanRequest{}, "", nil, err
+		}
+		sr.Profile = profileUser[0]
+	}
+	for _, k := range settingsKeys {
+		v, ok := qs[k]
+		if !ok {
+			continue
+		}
+		if len(v) != 1 {
+			err := fmt.Errorf("only one %s can be set, received: %+v", strings.TrimPrefix(k, "set"), v)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+			return scanRequest{}, "", nil, err
+		}
+		switch k {
+		case cmdSetthreads:
+			sr.Threads = v[0]
+		case cmdSettimeout:
+			sr.Timeout = v[0]
+		case cmdSetretries:
+			sr.Retries = v[0]
+		case cmdSetrate:
+			sr.Rate = v[0]
+		}
+	}
+	if ttlCmd {
+		if len(ttlUser) != 1 {
+			err := fmt.Errorf("only one ttl can be set, received: %+v", ttlUser)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+			return scanRequest{}, "", nil, err
+		}
+		sr.TTL = ttlUser[0]
+	}
+	if priorityCmd {
+		if len(priorityUser) != 1 {
+			err := fmt.Errorf("%s", scan.InvalidPriority)
 			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
-			return nil, "", "", nil, err
+			return scanRequest{}, "", nil, err
 		}
-		port, err = scan.ValidatePort(portUser[0])
+		sr.Priority = priorityUser[0]
+	}
+	if rdnsCmd {
+		if len(rdnsUser) != 1 {
+			err := fmt.Errorf("%s", scan.InvalidRDNS)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
+			return scanRequest{}, "", nil, err
+		}
+		sr.RDNS, err = scan.ValidateRDNS(rdnsUser[0])
 		if err != nil {
 			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
-			return nil, "", "", nil, err
+			return scanRequest{}, "", nil, err
 		}
 	}
 
-	if ipsCmd {
-		for i := range ipsUser {
-			ips = append(ips, strings.Split(ipsUser[i], ",")...)
+	req, status, err := validateScanRequest(sr, r.RemoteAddr)
+	if err != nil {
+		msg := fmt.Sprintf("%+v\n", err)
+		if status == http.StatusForbidden {
+			msg = "ERROR: " + msg
 		}
-		ips, err = scan.ValidateIPs(ips, false)
+		writeError(w, status, msg)
+		return scanRequest{}, "", nil, err
+	}
+
+	return req, "", nil, nil
+}
+
+// validateScanRequest validates the user supplied sr, including checking the targets against the
+// policy, and returns the scanRequest. On error, status is the HTTP status to return.
+func validateScanRequest(sr scan.Request, remoteAddr string) (req scanRequest, status int, err error) {
+	if sr.Budget != "" {
+		req.budget, err = scan.ValidateBudget(sr.Budget)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, fmt.Sprintf("%+v\n", err))
-			return nil, "", "", nil, err
+			return scanRequest{}, http.StatusBadRequest, err
+		}
+	}
+
+	req.settings = scan.Settings{Threads: *threads, Timeout: *timeout}
+	if sr.Profile != "" {
+		req.settings, err = scan.ValidateProfile(profiles, strings.ToLower(sr.Profile))
+		if err != nil {
+			return scanRequest{}, http.StatusBadRequest, err
 		}
 	}
+	req.settings, status, err = applyOverrides(req.settings, sr)
+	if err != nil {
+		if status == http.StatusForbidden {
+			fmt.Printf("WARNING: denied settings of scan request from %s\n", remoteAddr)
+		}
+		return scanRequest{}, status, err
+	}
+
+	req.rdns = sr.RDNS
+
+	if sr.Webhook != "" {
+		if err := validateWebhook(sr.Webhook); err != nil {
+			return scanRequest{}, http.StatusBadRequest, err
+		}
+		req.webhook = sr.Webhook
+	}
+
+	if sr.Priority != "" {
+		req.priority, err = scan.ValidatePriority(sr.Priority)
+		if err != nil {
+			return scanRequest{}, http.StatusBadRequest, err
+		}
+	}
+	req.submitter = remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		req.submitter = host
+	}
+
+	if sr.TTL != "" {
+		req.ttl, err = scan.ParseDuration(sr.TTL)
+		if err != nil || req.ttl <= 0 || req.ttl > *resultsMaxTTL {
+			return scanRequest{}, http.StatusBadRequest,
+				fmt.Errorf("invalid TTL %s; must be a duration or integer seconds > 0 and <= %s", sr.TTL, *resultsMaxTTL)
+		}
+	}
+
+	req.port, err = scan.ValidatePort(sr.Port)
+	if err != nil {
+		return scanRequest{}, http.StatusBadRequest, err
+	}
+
+	req.ips, err = scan.ValidateIPs(sr.IPs, false)
+	if err != nil {
+		return scanRequest{}, http.StatusBadRequest, err
+	}
+	if err := policy.permittedIPs(req.ips); err != nil {
+		fmt.Printf("WARNING: denied scan request from %s\n", remoteAddr)
+		return scanRequest{}, http.StatusForbidden, err
+	}
+	if req.priority == "" {
+		req.priority = defaultPriority(len(req.ips))
+	}
 
-	return ips, port, "", nil, err
+	return req, http.StatusOK, nil
 }
 
-// addResultRemoveOldest adds the specified results to the map of results. The oldest result
-// is removed from the map of output results if there are >=resultsQueueSize results in the map.
-func addResultRemoveOldest(id string, rslts scan.Results) {
-	resultsMapLock.Lock()
-	resultsMap[id] = rslts
-	if len(resultsQueue) >= resultsQueueSize {
-		oldestResult := <-resultsQueue
-		delete(resultsMap, oldestResult)
+// defaultPriority returns the priority of a scan of the specified number of targets that does not
+// specify one: interactive up to the interactivetargets flag, otherwise batch, so that large scans
+// do not take the workers of small ones.
+func defaultPriority(targets int) string {
+	if targets <= *interactiveTargets {
+		return scan.PriorityInteractive
 	}
-	resultsMapLock.Unlock()
+	return scan.PriorityBatch
 }
 
 // uniqueID generates unique IDs (UUIDs)
 func uniqueID() (id string, err error) {
 	idBin := make([]byte, 16)
-	// rand is not initialized in this implementation; initialize rand if unique data per run
-	// is required.
 	_, err = rand.Read(idBin)
 	if err != nil {
 		err := fmt.Errorf("creating unique binary ID, error: %+v", err)
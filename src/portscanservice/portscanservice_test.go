@@ -20,7 +20,7 @@ import (
 
 // TestQueryParams validates that any bad combination of query parameters does return bad status.
 func TestQueryParams(t *testing.T) {
-	timeout = time.Duration(100) * time.Millisecond
+	*timeout = time.Duration(100) * time.Millisecond
 	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
 	defer ts.Close()
 	badQueries := []string{
@@ -28,7 +28,21 @@ func TestQueryParams(t *testing.T) {
 		"?results=&setports=",
 		"?results=&setips=&setports=",
 		"?setports=",
-		"?setips="}
+		"?setips=",
+		"?results=&setbudget=5m",
+		"?setips=8.8.8.8&setport=443&setbudget=-1",
+		"?setips=8.8.8.8&setport=443&setbudget=soon",
+		"?setips=8.8.8.8&setport=443&setprofile=missing",
+		"?status=&setprofile=gentle",
+		"?setips=8.8.8.8&setport=443&setrdns=maybe",
+		"?setips=8.8.8.8&setport=443&setttl=0",
+		"?setips=8.8.8.8&setport=443&setttl=100000h",
+		"?status=&setthreads=5",
+		"?setips=8.8.8.8&setport=443&setthreads=0",
+		"?setips=8.8.8.8&setport=443&settimeout=1h",
+		"?setips=8.8.8.8&setport=443&setretries=1&setretries=2",
+		"?delete=&results=",
+		"?delete=&setips=8.8.8.8&setport=443"}
 	for i := range badQueries {
 		resp, err := http.Get(ts.URL + badQueries[i])
 		if resp.StatusCode < http.StatusBadRequest {
@@ -38,6 +52,30 @@ func TestQueryParams(t *testing.T) {
 	}
 }
 
+// TestDefaultPriority validates that a scan that does not specify a priority is interactive up to
+// interactivetargets targets, and batch beyond.
+func TestDefaultPriority(t *testing.T) {
+	defer func(targets int) { *interactiveTargets = targets }(*interactiveTargets)
+	*interactiveTargets = 2
+
+	tests := []struct {
+		sr       scan.Request
+		expected string
+	}{
+		{scan.Request{IPs: []string{"10.0.0.1", "10.0.0.2"}, Port: "443"}, scan.PriorityInteractive},
+		{scan.Request{IPs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, Port: "443"}, scan.PriorityBatch},
+		{scan.Request{IPs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, Port: "443", Priority: scan.PriorityInteractive},
+			scan.PriorityInteractive},
+		{scan.Request{IPs: []string{"10.0.0.1"}, Port: "443", Priority: scan.PriorityBatch}, scan.PriorityBatch},
+	}
+	for _, v := range tests {
+		req, status, err := validateScanRequest(v.sr, "10.1.1.1:1234")
+		if err != nil || status != http.StatusOK || req.priority != v.expected {
+			t.Errorf("Unexpected priority for %+v: %s, status: %d, error: %+v", v.sr, req.priority, status, err)
+		}
+	}
+}
+
 type testInput struct {
 	ips               string
 	port              string
@@ -49,9 +87,13 @@ type testInput struct {
 // Minimal test to verify that IPs and port are parsed and expected results returned.
 // Does not test IPV6, CSV with a bad IP in the middle of a string of good IPS.
 // Does not run a server and validate good responses.
-// Does not validate deleting results or depth of queue.
+// Does not validate result retention; see store_test.go.
 func TestIPsAndPorts(t *testing.T) {
-	timeout = time.Duration(100) * time.Millisecond
+	*timeout = time.Duration(100) * time.Millisecond
+	// Loopback is denied by default; allow it so the tests can scan this host.
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8", "0.0.0.0/0"}, nil)
+	defer func() { policy = defaultPolicy }()
 	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
 	defer ts.Close()
 
@@ -92,7 +134,7 @@ func TestIPsAndPorts(t *testing.T) {
 			}
 
 			id := scan.ID{}
-			time.Sleep(timeout)
+			time.Sleep(*timeout)
 			time.Sleep(time.Duration(100) * time.Millisecond)
 			json.Unmarshal(body, &id)
 			fmt.Printf("ID: %+v\n", id)
@@ -124,3 +166,42 @@ func TestIPsAndPorts(t *testing.T) {
 		}
 	}
 }
+
+// TestStatus validates that the state and progress of a scan can be retrieved by ID.
+func TestStatus(t *testing.T) {
+	*timeout = time.Duration(100) * time.Millisecond
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { policy = defaultPolicy }()
+	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?setips=127.0.0.1,127.0.0.2&setport=4430")
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	id := scan.ID{}
+	json.Unmarshal(body, &id)
+
+	time.Sleep(*timeout)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	resp, err = http.Get(ts.URL + fmt.Sprintf("?status=%s", id.ID))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error getting status, error: %+v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	status := scan.Job{}
+	json.Unmarshal(body, &status)
+	if status.ID != id.ID || status.State != scan.JobCompleted || status.Completed != 2 || status.Total != 2 ||
+		status.Results != nil {
+		t.Errorf("Unexpected status: %s", body)
+	}
+
+	resp, err = http.Get(ts.URL + "?status=not_an_id")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected response for status of an unknown ID, error: %+v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+// results.go writes the results of a job as NDJSON (JSON Lines; one scan.Result per line) for the
+// results query with format=ndjson, and GET /v2/scans/{id}/results?format=ndjson. NDJSON is
+// written incrementally, so large results are never marshalled into one buffer, and are not
+// subject to writeTimeout; see isStreaming.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+const (
+	// Values of the format query key.
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+
+	ndjsonContentType = "application/x-ndjson"
+	// ndjsonFlushLines is the number of lines written between flushes.
+	ndjsonFlushLines = 1000
+)
+
+// ndjsonResults are results to be written as NDJSON by handlerIndex.
+type ndjsonResults scan.Results
+
+// validateFormat returns the format for the value of the format query key; the default is JSON.
+func validateFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", formatJSON:
+		return formatJSON, nil
+	case formatNDJSON:
+		return formatNDJSON, nil
+	}
+	return "", fmt.Errorf("invalid format %s; must be %s or %s", format, formatJSON, formatNDJSON)
+}
+
+// writeNDJSON writes results with the specified status, one per line, flushing as it goes. Writing
+// stops at the first error, I.E. when the client disconnects.
+func writeNDJSON(w http.ResponseWriter, status int, results scan.Results) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i := range results {
+		if err := enc.Encode(results[i]); err != nil {
+			fmt.Printf("ERROR: writing results, error: %+v\n", err)
+			return
+		}
+		if flusher != nil && (i+1)%ndjsonFlushLines == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+// isNDJSON returns true if the query of r requests NDJSON; query keys and values are case
+// insensitive, as for the query string API.
+func isNDJSON(r *http.Request) bool {
+	qs, err := url.ParseQuery(strings.ToLower(r.URL.RawQuery))
+	return err == nil && qs.Get(cmdFormat) == formatNDJSON
+}
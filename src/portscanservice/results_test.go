@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestValidateFormat validates values of the format query key.
+func TestValidateFormat(t *testing.T) {
+	// formatMap is a map of format/expected pairs; an empty expected format is an error.
+	formatMap := map[string]string{"": formatJSON, "json": formatJSON, "NDJSON": formatNDJSON, "xml": ""}
+	for k, v := range formatMap {
+		format, err := validateFormat(k)
+		if format != v || (err == nil) != (v != "") {
+			t.Errorf("Format %q was validated incorrectly: %s, error: %+v", k, format, err)
+		}
+	}
+}
+
+// TestNDJSON validates NDJSON results from the query string and v2 APIs.
+func TestNDJSON(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	refused := "connect: connection refused"
+	results := scan.Results{{IP: "10.0.0.1", Port: "22", Error: &refused}, {IP: "10.0.0.2", Port: "22", Error: &refused},
+		{IP: "10.0.0.3", Port: "22", Error: &refused}}
+	j := doneJob(jobs, results, 0)
+
+	for _, path := range []string{"/?results=" + j.id + "&format=ndjson", "/?RESULTS=" + j.id + "&FORMAT=NDJSON",
+		v2ScansPath + "/" + j.id + "/" + v2Results + "?format=ndjson"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Error from get, error: %+v", err)
+		}
+		lines := 0
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			r := scan.Result{}
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.IP != results[lines].IP {
+				t.Errorf("Unexpected line %d for %s: %s, error: %+v", lines, path, scanner.Bytes(), err)
+			}
+			lines++
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ndjsonContentType || lines != len(results) {
+			t.Errorf("Unexpected response for %s, status: %d, headers: %+v, lines: %d", path, resp.StatusCode, resp.Header, lines)
+		}
+	}
+
+	status, body := doV2(t, ts, http.MethodGet, v2ScansPath+"/"+j.id+"/"+v2Results, "")
+	rs := scan.Results{}
+	if status != http.StatusOK || json.Unmarshal(body, &rs) != nil || len(rs) != len(results) || bytes.Count(body, []byte("\n")) != 0 {
+		t.Errorf("Unexpected JSON results, status: %d, body: %s", status, body)
+	}
+
+	tests := []v2Test{
+		{http.MethodGet, v2ScansPath + "/" + j.id + "/" + v2Results + "?format=xml", ``, http.StatusBadRequest},
+		{http.MethodGet, v2ScansPath + "/not_an_id/" + v2Results, ``, http.StatusNotFound},
+		{http.MethodGet, "/?results=" + j.id + "&format=xml", ``, http.StatusBadRequest},
+		{http.MethodGet, "/?status=" + j.id + "&format=ndjson", ``, http.StatusBadRequest},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+// scheduler.go limits the work done by the service: a jobScheduler limits the number of running
+// jobs, queueing or rejecting the rest, and a workerPool limits the connection attempts in flight
+// across all running jobs, granting free workers to jobs in weighted round-robin order so a large
+// job cannot starve a small one.
+// Queued jobs run by priority, interactive before batch, and then fairly between submitters: the
+// next job is that of the submitter with the fewest running jobs. Paused jobs are passed over.
+// When the service shuts down the scheduler is drained: no further jobs are submitted or started.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// errQueueFull is returned when a job cannot be run or queued; callers should retry later.
+var errQueueFull = errors.New("the service is at capacity, try again later")
+
+// errShuttingDown is returned when a job is submitted after the scheduler is drained.
+var errShuttingDown = errors.New("the service is shutting down, try again later")
+
+// priorityWeights are the number of workers granted in turn to a running job of each priority.
+var priorityWeights = map[string]int{scan.PriorityInteractive: 4, scan.PriorityBatch: 1}
+
+// jobScheduler runs jobs, in the order given by nextIndex, when fewer than maxRunning are running.
+type jobScheduler struct {
+	mu sync.Mutex
+	// queue are the jobs waiting to run, oldest first.
+	queue   []*job
+	running int
+	// submitters is the number of running jobs of each submitter.
+	submitters map[string]int
+
+	maxRunning int
+	// maxQueued limits the length of queue; jobs submitted beyond it are rejected.
+	maxQueued int
+	pool      *workerPool
+
+	// drained is closed once the scheduler is draining and no jobs are running; nil until drain is
+	// called.
+	drained chan struct{}
+}
+
+// newJobScheduler returns a scheduler sharing workers between at most maxRunning jobs, and queueing
+// at most maxQueued.
+func newJobScheduler(workers int, maxRunning int, maxQueued int) *jobScheduler {
+	return &jobScheduler{submitters: make(map[string]int), maxRunning: maxRunning, maxQueued: maxQueued,
+		pool: newWorkerPool(workers)}
+}
+
+// submit runs j when fewer than maxRunning jobs are running. Returns errQueueFull if j can neither
+// run nor be queued, or errShuttingDown if the scheduler is draining. The queue never holds more
+// than maxQueued jobs, whatever the number running, as paused jobs stay queued.
+func (s *jobScheduler) submit(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained != nil {
+		return errShuttingDown
+	}
+	s.queue = append(s.queue, j)
+	s.startLocked()
+	// j was not started, and does not fit in the queue.
+	if len(s.queue) > s.maxQueued {
+		s.queue = s.queue[:len(s.queue)-1]
+		return errQueueFull
+	}
+	return nil
+}
+
+// startLocked starts queued jobs while fewer than maxRunning are running, unless the scheduler is
+// draining.
+func (s *jobScheduler) startLocked() {
+	if s.drained != nil {
+		if s.running == 0 {
+			select {
+			case <-s.drained:
+			default:
+				close(s.drained)
+			}
+		}
+		return
+	}
+	for s.running < s.maxRunning {
+		i := nextIndex(s.queue, s.submitters)
+		if i < 0 {
+			break
+		}
+		j := s.queue[i]
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.running++
+		s.submitters[j.req.submitter]++
+		go func() {
+			j.run(s.pool.client(priorityWeights[j.req.priority]))
+			s.mu.Lock()
+			s.running--
+			s.submitters[j.req.submitter]--
+			if s.submitters[j.req.submitter] == 0 {
+				delete(s.submitters, j.req.submitter)
+			}
+			s.startLocked()
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// remove removes j from the queue. Returns false if j is not queued, I.E. it has been started.
+func (s *jobScheduler) remove(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.queue {
+		if s.queue[i] == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// start starts queued jobs while fewer than maxRunning are running, I.E. once a queued job is
+// unpaused.
+func (s *jobScheduler) start() {
+	s.mu.Lock()
+	s.startLocked()
+	s.mu.Unlock()
+}
+
+// drain stops jobs being submitted or started; queued jobs stay queued. The returned channel is
+// closed once no jobs are running.
+func (s *jobScheduler) drain() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		s.startLocked()
+	}
+	return s.drained
+}
+
+// draining returns true once drain has been called.
+func (s *jobScheduler) draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drained != nil
+}
+
+// position returns the 1 based position of j in the run order of the queue, or 0 if j is not queued.
+func (s *jobScheduler) position(j *job) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := append([]*job{}, s.queue...)
+	submitters := make(map[string]int, len(s.submitters))
+	for k, v := range s.submitters {
+		submitters[k] = v
+	}
+	for pos := 1; ; pos++ {
+		i := nextIndex(queue, submitters)
+		if i < 0 {
+			return 0
+		}
+		if queue[i] == j {
+			return pos
+		}
+		submitters[queue[i].req.submitter]++
+		queue = append(queue[:i], queue[i+1:]...)
+	}
+}
+
+// nextIndex returns the index in queue of the job to run next: interactive before batch, then the
+// job of the submitter with the fewest jobs in submitters, then the oldest. Paused jobs are passed
+// over; returns -1 if no job can run.
+func nextIndex(queue []*job, submitters map[string]int) int {
+	next := -1
+	for i := 0; i < len(queue); i++ {
+		if atomic.LoadInt32(&queue[i].held) != 0 {
+			continue
+		}
+		if next < 0 {
+			next = i
+			continue
+		}
+		a, b := queue[i].req, queue[next].req
+		if a.priority != b.priority {
+			if a.priority == scan.PriorityInteractive {
+				next = i
+			}
+			continue
+		}
+		if submitters[a.submitter] < submitters[b.submitter] {
+			next = i
+		}
+	}
+	return next
+}
+
+// workerPool shares a fixed number of workers between clients; each connection attempt holds a
+// worker.
+type workerPool struct {
+	mu sync.Mutex
+	// free is the number of workers not in use.
+	free int
+	// waiting are the clients with attempts waiting for a worker, in the order they are served.
+	waiting []*poolClient
+}
+
+// poolClient is the scan.Limiter for a single job.
+type poolClient struct {
+	pool *workerPool
+	// weight is the number of workers granted to the client in turn; granted counts them.
+	weight  int
+	granted int
+	// waiters are the attempts waiting for a worker, oldest first. A waiter is granted a worker
+	// by closing its channel.
+	waiters []chan struct{}
+}
+
+// newWorkerPool returns a pool of the specified number of workers.
+func newWorkerPool(workers int) *workerPool {
+	return &workerPool{free: workers}
+}
+
+// client returns a new client of the pool with the specified weight; a weight less than 1 is 1.
+func (p *workerPool) client(weight int) *poolClient {
+	if weight < 1 {
+		weight = 1
+	}
+	return &poolClient{pool: p, weight: weight}
+}
+
+// Acquire waits for a worker. Workers are granted to waiting clients in turn, up to the weight
+// of each client per turn, and to the attempts of a client oldest first.
+func (c *poolClient) Acquire(ctx context.Context) error {
+	p := c.pool
+	p.mu.Lock()
+	if p.free > 0 && len(p.waiting) == 0 {
+		p.free--
+		p.mu.Unlock()
+		return nil
+	}
+	grant := c.enqueueLocked()
+	p.mu.Unlock()
+
+	select {
+	case <-grant:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-grant:
+		// Granted as ctx was done; pass the worker on.
+		p.releaseLocked()
+	default:
+		c.dequeueLocked(grant)
+	}
+	return ctx.Err()
+}
+
+// Release returns a worker to the pool.
+func (c *poolClient) Release() {
+	c.pool.mu.Lock()
+	c.pool.releaseLocked()
+	c.pool.mu.Unlock()
+}
+
+// enqueueLocked adds a waiter for c, and returns it.
+func (c *poolClient) enqueueLocked() chan struct{} {
+	grant := make(chan struct{})
+	if len(c.waiters) == 0 {
+		c.pool.waiting = append(c.pool.waiting, c)
+	}
+	c.waiters = append(c.waiters, grant)
+	return grant
+}
+
+// dequeueLocked removes the waiter grant, which has not been granted a worker.
+func (c *poolClient) dequeueLocked(grant chan struct{}) {
+	for i := range c.waiters {
+		if c.waiters[i] == grant {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters) > 0 {
+		return
+	}
+	c.granted = 0
+	p := c.pool
+	for i := range p.waiting {
+		if p.waiting[i] == c {
+			p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+			break
+		}
+	}
+}
+
+// releaseLocked grants a worker to the oldest waiter of the next waiting client, moving that client
+// to the back of the line once it has been granted its weight, or frees the worker if no client
+// is waiting.
+func (p *workerPool) releaseLocked() {
+	if len(p.waiting) == 0 {
+		p.free++
+		return
+	}
+	c := p.waiting[0]
+	grant := c.waiters[0]
+	c.waiters = c.waiters[1:]
+	c.granted++
+	if len(c.waiters) == 0 || c.granted >= c.weight {
+		p.waiting = p.waiting[1:]
+		c.granted = 0
+		if len(c.waiters) > 0 {
+			p.waiting = append(p.waiting, c)
+		}
+	}
+	close(grant)
+}
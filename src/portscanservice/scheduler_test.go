@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// granted returns whether grant was closed.
+func granted(grant chan struct{}) bool {
+	select {
+	case <-grant:
+		return true
+	default:
+		return false
+	}
+}
+
+// TestWorkerPoolRoundRobin validates that workers are granted to waiting clients in turn.
+func TestWorkerPoolRoundRobin(t *testing.T) {
+	p := newWorkerPool(1)
+	a, b := p.client(1), p.client(1)
+	if err := a.Acquire(context.Background()); err != nil {
+		t.Fatalf("Error acquiring a free worker: %+v", err)
+	}
+
+	p.mu.Lock()
+	a1, a2, b1 := a.enqueueLocked(), a.enqueueLocked(), b.enqueueLocked()
+	p.mu.Unlock()
+	grants := []chan struct{}{a1, b1, a2}
+	for i := range grants {
+		a.Release()
+		for k := range grants {
+			if granted(grants[k]) != (k <= i) {
+				t.Errorf("Unexpected grants after %d releases, waiter %d granted: %t", i+1, k, granted(grants[k]))
+			}
+		}
+	}
+	a.Release()
+	if p.free != 1 || len(p.waiting) != 0 {
+		t.Errorf("Unexpected pool after all releases: %+v", p)
+	}
+}
+
+// TestWorkerPoolWeights validates that a client is granted up to its weight of workers per turn.
+func TestWorkerPoolWeights(t *testing.T) {
+	p := newWorkerPool(1)
+	a, b := p.client(2), p.client(1)
+	if err := a.Acquire(context.Background()); err != nil {
+		t.Fatalf("Error acquiring a free worker: %+v", err)
+	}
+
+	p.mu.Lock()
+	a1, a2, a3, b1 := a.enqueueLocked(), a.enqueueLocked(), a.enqueueLocked(), b.enqueueLocked()
+	p.mu.Unlock()
+	grants := []chan struct{}{a1, a2, b1, a3}
+	for i := range grants {
+		a.Release()
+		for k := range grants {
+			if granted(grants[k]) != (k <= i) {
+				t.Errorf("Unexpected grants after %d releases, waiter %d granted: %t", i+1, k, granted(grants[k]))
+			}
+		}
+	}
+}
+
+// TestWorkerPoolCancel validates that an attempt waiting for a worker stops when its context is done.
+func TestWorkerPoolCancel(t *testing.T) {
+	p := newWorkerPool(1)
+	a, b := p.client(1), p.client(1)
+	if err := a.Acquire(context.Background()); err != nil {
+		t.Fatalf("Error acquiring a free worker: %+v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Acquire(ctx); err == nil {
+		t.Errorf("Acquired a worker from a pool with none free")
+	}
+	if len(p.waiting) != 0 || len(b.waiters) != 0 {
+		t.Errorf("Waiter was not removed: %+v", p)
+	}
+	a.Release()
+	if p.free != 1 {
+		t.Errorf("Unexpected free workers: %d", p.free)
+	}
+}
+
+// TestSchedulerFull validates that jobs are queued up to the limit, then rejected with status 429.
+func TestSchedulerFull(t *testing.T) {
+	defaultScheduler := scheduler
+	scheduler = newJobScheduler(1, 0, 1)
+	defer func() { scheduler = defaultScheduler }()
+
+	if err := scheduler.submit(&job{}); err != nil {
+		t.Errorf("Error queueing a job: %+v", err)
+	}
+	if err := scheduler.submit(&job{}); err != errQueueFull {
+		t.Errorf("Unexpected error submitting a job with the queue full: %+v", err)
+	}
+
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+	if status, body := doV2(t, ts, http.MethodPost, v2ScansPath, `{"IPs":["8.8.8.8"],"Port":"443"}`); status != http.StatusTooManyRequests {
+		t.Errorf("Unexpected response with the queue full, status: %d, body: %s", status, body)
+	}
+	resp, err := http.Get(ts.URL + "?setips=8.8.8.8&setport=443")
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status with the queue full: %d", resp.StatusCode)
+	}
+}
+
+// TestSchedulerFullPaused validates that paused jobs count towards the queue limit while fewer than
+// maxRunning jobs are running, and that a job that can run is not limited by the queue.
+func TestSchedulerFullPaused(t *testing.T) {
+	defaultScheduler := scheduler
+	scheduler = newJobScheduler(1, 1, 1)
+	defer func() { scheduler = defaultScheduler }()
+
+	if err := scheduler.submit(&job{held: 1}); err != nil {
+		t.Errorf("Error queueing a paused job: %+v", err)
+	}
+	if err := scheduler.submit(&job{held: 1}); err != errQueueFull {
+		t.Errorf("Unexpected error submitting a paused job with the queue full: %+v", err)
+	}
+	if len(scheduler.queue) != 1 || scheduler.running != 0 {
+		t.Errorf("Unexpected queue: %+v, running: %d", scheduler.queue, scheduler.running)
+	}
+
+	scheduler = newJobScheduler(1, 1, 0)
+	j, err := newJob(scanRequest{ips: []string{"10.0.0.1"}, port: "443"})
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	j.cancel()
+	if err := scheduler.submit(j); err != nil {
+		t.Errorf("Error running a job with no queue: %+v", err)
+	}
+	waitDone(t, j)
+}
+
+// TestSchedulerOrder validates that queued jobs run interactive first, then fairly between
+// submitters, then oldest first; and the reported queue positions.
+func TestSchedulerOrder(t *testing.T) {
+	defaultScheduler := scheduler
+	scheduler = newJobScheduler(1, 0, 10)
+	defer func() { scheduler = defaultScheduler }()
+
+	// a has a job running, so b's batch job runs before a's, but after all interactive jobs.
+	scheduler.submitters["a"] = 1
+	queued := []*job{
+		{id: "a-batch", state: scan.JobQueued, req: scanRequest{priority: scan.PriorityBatch, submitter: "a"}},
+		{id: "a-interactive", state: scan.JobQueued, req: scanRequest{priority: scan.PriorityInteractive, submitter: "a"}},
+		{id: "b-batch", state: scan.JobQueued, req: scanRequest{priority: scan.PriorityBatch, submitter: "b"}},
+		{id: "b-interactive", state: scan.JobQueued, req: scanRequest{priority: scan.PriorityInteractive, submitter: "b"}},
+		{id: "b-batch-2", state: scan.JobQueued, req: scanRequest{priority: scan.PriorityBatch, submitter: "b"}},
+	}
+	for _, j := range queued {
+		if err := scheduler.submit(j); err != nil {
+			t.Fatalf("Error queueing job %s: %+v", j.id, err)
+		}
+	}
+
+	expected := map[string]int{"b-interactive": 1, "a-interactive": 2, "b-batch": 3, "a-batch": 4, "b-batch-2": 5}
+	for _, j := range queued {
+		if sj := j.snapshot(false); sj.Position != expected[j.id] || sj.Priority != j.req.priority {
+			t.Errorf("Unexpected position for job %s: %+v", j.id, sj)
+		}
+	}
+	if p := scheduler.position(&job{}); p != 0 {
+		t.Errorf("Unexpected position for a job that is not queued: %d", p)
+	}
+}
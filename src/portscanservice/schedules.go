@@ -0,0 +1,317 @@
+package main
+
+// schedules.go runs scans on a schedule, given as a cron expression or an interval. Each run is a
+// job linked to the schedule by the schedule ID. A run is skipped if the previous run is not done,
+// so runs of a schedule never overlap.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// schedule is a recurring scan. Fields other than id, sr, req, cron and interval are protected
+// by mu.
+type schedule struct {
+	mu sync.Mutex
+	id string
+	// sr is the request as given by the caller; req is the validated request for each run.
+	sr  scan.ScheduleRequest
+	req scanRequest
+	// cron is nil for a schedule with an interval.
+	cron     *cronExpr
+	interval time.Duration
+
+	paused    bool
+	created   time.Time
+	lastRun   time.Time
+	lastJobID string
+	nextRun   time.Time
+	skipped   int
+}
+
+// scheduleRecord is the persisted form of a schedule.
+type scheduleRecord struct {
+	Schedule scan.Schedule
+	Request  requestRecord
+}
+
+// scheduleStore holds schedules by ID.
+type scheduleStore struct {
+	mu        sync.RWMutex
+	schedules map[string]*schedule
+	// backend persists schedules when they change.
+	backend jobBackend
+}
+
+// minScheduleInterval is the shortest interval a schedule may have.
+const minScheduleInterval = time.Minute
+
+// newSchedule returns a schedule for sr, where req is the validated sr.Scan. The first run is due
+// at the first time matching the cron expression, or one interval after now.
+func newSchedule(sr scan.ScheduleRequest, req scanRequest, now time.Time) (*schedule, error) {
+	s := &schedule{sr: sr, req: req, created: now}
+	var err error
+	switch {
+	case sr.Cron != "" && sr.Interval != "":
+		return nil, fmt.Errorf("only one of Cron and Interval may be specified")
+	case sr.Cron != "":
+		if s.cron, err = parseCron(sr.Cron); err != nil {
+			return nil, err
+		}
+	case sr.Interval != "":
+		s.interval, err = scan.ParseDuration(sr.Interval)
+		if err != nil || s.interval < minScheduleInterval {
+			return nil, fmt.Errorf("invalid interval %s; must be a duration or integer seconds >= %s",
+				sr.Interval, minScheduleInterval)
+		}
+	default:
+		return nil, fmt.Errorf("one of Cron or Interval is required")
+	}
+
+	if sr.Webhook != "" {
+		if err := validateWebhook(sr.Webhook); err != nil {
+			return nil, err
+		}
+	}
+
+	s.nextRun = s.next(now)
+	if s.nextRun.IsZero() {
+		return nil, fmt.Errorf("cron expression %s never matches", sr.Cron)
+	}
+	if s.id, err = uniqueID(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// next returns the time of the first run after t.
+func (s *schedule) next(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(t)
+	}
+	return t.Add(s.interval)
+}
+
+// snapshot returns the schedule as a scan.Schedule; the IDs of its runs are included if
+// includeJobs is true.
+func (s *schedule) snapshot(includeJobs bool) scan.Schedule {
+	s.mu.Lock()
+	ss := scan.Schedule{ID: s.id, ScheduleRequest: s.sr, Paused: s.paused, Created: s.created,
+		LastRun: s.lastRun, LastJobID: s.lastJobID, NextRun: s.nextRun, Skipped: s.skipped}
+	s.mu.Unlock()
+
+	if includeJobs {
+		for _, sj := range jobs.list() {
+			if sj.ScheduleID == s.id {
+				ss.Jobs = append(ss.Jobs, sj.ID)
+			}
+		}
+	}
+	return ss
+}
+
+// completedRuns returns the IDs of the completed runs of s that have not been removed, oldest
+// first.
+func (s *schedule) completedRuns() []string {
+	out := []string{}
+	for _, sj := range jobs.list() {
+		if sj.ScheduleID == s.id && sj.State == scan.JobCompleted {
+			out = append(out, sj.ID)
+		}
+	}
+	return out
+}
+
+// pause stops the schedule starting runs; a run in progress is not affected. Returns false if the
+// schedule is already paused.
+func (s *schedule) pause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		return false
+	}
+	s.paused = true
+	s.nextRun = time.Time{}
+	return true
+}
+
+// unpause resumes a paused schedule; the next run is the first due after now. Returns false if the
+// schedule is not paused.
+func (s *schedule) unpause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return false
+	}
+	s.paused = false
+	s.nextRun = s.next(time.Now())
+	return true
+}
+
+// newScheduleStore returns an empty scheduleStore persisting schedules to backend. Call restore to
+// add the schedules in backend.
+func newScheduleStore(backend jobBackend) *scheduleStore {
+	return &scheduleStore{schedules: make(map[string]*schedule), backend: backend}
+}
+
+// add adds s to the store. A schedule with the same ID is not replaced.
+func (ss *scheduleStore) add(s *schedule) error {
+	ss.mu.Lock()
+	if _, ok := ss.schedules[s.id]; ok {
+		ss.mu.Unlock()
+		return fmt.Errorf("schedule %s already exists", s.id)
+	}
+	ss.schedules[s.id] = s
+	ss.mu.Unlock()
+	ss.save(s)
+	return nil
+}
+
+// save writes s to the backend, unless s was deleted; errors are logged, as the schedule is still
+// available from memory.
+func (ss *scheduleStore) save(s *schedule) {
+	// Hold the lock while writing, so a concurrent delete cannot be undone.
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	if ss.schedules[s.id] != s {
+		return
+	}
+	rec := scheduleRecord{Schedule: s.snapshot(false), Request: newRequestRecord(s.req)}
+	if err := ss.backend.saveSchedule(rec); err != nil {
+		fmt.Printf("ERROR: saving schedule %s, error: %+v\n", s.id, err)
+	}
+}
+
+// get returns the schedule with the specified ID.
+func (ss *scheduleStore) get(id string) (*schedule, bool) {
+	ss.mu.RLock()
+	s, ok := ss.schedules[id]
+	ss.mu.RUnlock()
+	return s, ok
+}
+
+// delete removes the schedule with the specified ID; its runs are kept.
+func (ss *scheduleStore) delete(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.schedules, id)
+	if err := ss.backend.removeSchedule(id); err != nil {
+		fmt.Printf("ERROR: removing schedule %s, error: %+v\n", id, err)
+	}
+}
+
+// list returns all schedules, oldest first, without the IDs of their runs.
+func (ss *scheduleStore) list() []scan.Schedule {
+	ss.mu.RLock()
+	out := make([]scan.Schedule, 0, len(ss.schedules))
+	for _, s := range ss.schedules {
+		out = append(out, s.snapshot(false))
+	}
+	ss.mu.RUnlock()
+	sort.Slice(out, func(i, k int) bool {
+		if out[i].Created.Equal(out[k].Created) {
+			return out[i].ID < out[k].ID
+		}
+		return out[i].Created.Before(out[k].Created)
+	})
+	return out
+}
+
+// restore adds the schedules in the backend. A run that was due while the service was stopped
+// starts at the next call to runDue. Schedules with targets no longer permitted by the target
+// policy are paused.
+func (ss *scheduleStore) restore() error {
+	recs, err := ss.backend.loadSchedules()
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		sched := rec.Schedule
+		s, err := newSchedule(sched.ScheduleRequest, rec.Request.scanRequest(), sched.Created)
+		if err != nil {
+			fmt.Printf("ERROR: restoring schedule %s, error: %+v\n", sched.ID, err)
+			continue
+		}
+		s.id, s.paused, s.lastRun, s.lastJobID, s.nextRun, s.skipped =
+			sched.ID, sched.Paused, sched.LastRun, sched.LastJobID, sched.NextRun, sched.Skipped
+		ss.mu.Lock()
+		ss.schedules[s.id] = s
+		ss.mu.Unlock()
+		if err := policy.permittedIPs(s.req.ips); err != nil && s.pause() {
+			fmt.Printf("WARNING: pausing schedule %s, error: %+v\n", s.id, err)
+			ss.save(s)
+		}
+	}
+	fmt.Printf("INFO: restored %d schedules.\n", len(recs))
+	return nil
+}
+
+// runDue starts the runs of schedules that are due as of now.
+func (ss *scheduleStore) runDue(now time.Time) {
+	due := []*schedule{}
+	ss.mu.RLock()
+	for _, s := range ss.schedules {
+		s.mu.Lock()
+		if !s.paused && !s.nextRun.IsZero() && !now.Before(s.nextRun) {
+			due = append(due, s)
+		}
+		s.mu.Unlock()
+	}
+	ss.mu.RUnlock()
+
+	for _, s := range due {
+		ss.run(s, now)
+	}
+}
+
+// run starts a run of s, unless the previous run is not done, and sets the time of the next run.
+func (ss *scheduleStore) run(s *schedule, now time.Time) {
+	s.mu.Lock()
+	last := s.lastJobID
+	s.nextRun = s.next(now)
+	s.mu.Unlock()
+	defer ss.save(s)
+
+	if j, ok := jobs.get(last); ok {
+		if sj := j.snapshot(false); !sj.Done() {
+			fmt.Printf("WARNING: skipping run of schedule %s, the previous run %s is %s\n", s.id, last, sj.State)
+			s.mu.Lock()
+			s.skipped++
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	req := s.req
+	req.scheduleID = s.id
+	// The policy may have changed since the schedule was created or restored.
+	err := policy.permittedIPs(req.ips)
+	id := ""
+	if err == nil {
+		id, err = startScan(req)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		fmt.Printf("ERROR: skipping run of schedule %s, error: %+v\n", s.id, err)
+		s.skipped++
+		return
+	}
+	fmt.Printf("INFO: schedule %s started job %s\n", s.id, id)
+	s.lastRun = now
+	s.lastJobID = id
+}
+
+// runEvery calls runDue at the specified interval, until the scheduler is draining.
+func (ss *scheduleStore) runEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if scheduler.draining() {
+			return
+		}
+		ss.runDue(now)
+	}
+}
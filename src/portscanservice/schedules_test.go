@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestNewSchedule validates schedule requests and the time of the first run.
+func TestNewSchedule(t *testing.T) {
+	now := time.Date(2021, 2, 3, 10, 30, 15, 0, time.UTC)
+	type scheduleTest struct {
+		sr      scan.ScheduleRequest
+		nextRun time.Time
+		pass    bool
+	}
+	tests := []scheduleTest{
+		{scan.ScheduleRequest{Cron: "0 2 * * *"}, time.Date(2021, 2, 4, 2, 0, 0, 0, time.UTC), true},
+		{scan.ScheduleRequest{Interval: "1h"}, now.Add(time.Hour), true},
+		{scan.ScheduleRequest{Interval: "120"}, now.Add(2 * time.Minute), true},
+		{scan.ScheduleRequest{Interval: "10s"}, time.Time{}, false},
+		{scan.ScheduleRequest{Interval: "often"}, time.Time{}, false},
+		{scan.ScheduleRequest{Cron: "0 2 * *"}, time.Time{}, false},
+		{scan.ScheduleRequest{Cron: "0 0 30 2 *"}, time.Time{}, false},
+		{scan.ScheduleRequest{Cron: "0 2 * * *", Interval: "1h"}, time.Time{}, false},
+		{scan.ScheduleRequest{}, time.Time{}, false},
+	}
+	for _, v := range tests {
+		s, err := newSchedule(v.sr, scanRequest{}, now)
+		if (err == nil) != v.pass {
+			t.Errorf("Schedule request %+v was validated incorrectly, error: %+v", v.sr, err)
+			continue
+		}
+		if err == nil && !s.nextRun.Equal(v.nextRun) {
+			t.Errorf("Unexpected next run for %+v: %s, expected: %s", v.sr, s.nextRun, v.nextRun)
+		}
+	}
+}
+
+// TestScheduleRuns validates that due schedules start runs linked to the schedule, that a run is
+// skipped while the previous run is not done, and that a paused schedule starts no runs.
+func TestScheduleRuns(t *testing.T) {
+	defaultScheduler, defaultPolicy := scheduler, policy
+	scheduler = newJobScheduler(1, 0, 2)
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { scheduler, policy = defaultScheduler, defaultPolicy }()
+
+	ss := newScheduleStore(newMemoryBackend())
+	now := time.Now()
+	req := scanRequest{ips: []string{"127.0.0.1"}, port: "4430",
+		settings: scan.Settings{Threads: 1, Timeout: 100 * time.Millisecond}}
+	s, err := newSchedule(scan.ScheduleRequest{Interval: "1m"}, req, now)
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	ss.add(s)
+
+	ss.runDue(now)
+	if sched := s.snapshot(false); sched.LastJobID != "" {
+		t.Errorf("Schedule ran before it was due: %+v", sched)
+	}
+
+	now = now.Add(time.Minute)
+	ss.runDue(now)
+	sched := s.snapshot(false)
+	first, ok := jobs.get(sched.LastJobID)
+	if !ok || !sched.LastRun.Equal(now) || !sched.NextRun.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Unexpected schedule after the first run: %+v", sched)
+	}
+	if sj := first.snapshot(false); sj.ScheduleID != s.id || sj.State != scan.JobQueued {
+		t.Errorf("Unexpected first run: %+v", sj)
+	}
+
+	// The first run is still queued, so the second is skipped.
+	now = now.Add(time.Minute)
+	ss.runDue(now)
+	if sched := s.snapshot(false); sched.LastJobID != first.id || sched.Skipped != 1 {
+		t.Errorf("Unexpected schedule after a skipped run: %+v", sched)
+	}
+
+	first.run(nil)
+	now = now.Add(time.Minute)
+	ss.runDue(now)
+	sched = s.snapshot(true)
+	if sched.LastJobID == first.id || len(sched.Jobs) != 2 {
+		t.Errorf("Unexpected schedule after the third run: %+v", sched)
+	}
+
+	if !s.pause() || s.pause() {
+		t.Errorf("Unexpected result pausing a schedule")
+	}
+	last := sched.LastJobID
+	ss.runDue(now.Add(time.Hour))
+	if sched := s.snapshot(false); sched.LastJobID != last || !sched.NextRun.IsZero() {
+		t.Errorf("Paused schedule ran: %+v", sched)
+	}
+	if !s.unpause() || s.unpause() || s.snapshot(false).NextRun.IsZero() {
+		t.Errorf("Unexpected result resuming a schedule")
+	}
+
+	// Runs are skipped once the targets are no longer permitted.
+	policy = defaultPolicy
+	sched = s.snapshot(false)
+	ss.runDue(sched.NextRun)
+	if after := s.snapshot(false); after.LastJobID != sched.LastJobID || after.Skipped != sched.Skipped+1 {
+		t.Errorf("Schedule ran with targets that are not permitted: %+v", after)
+	}
+}
+
+// TestScheduleRestore validates that schedules are restored from the backend, and that those with
+// targets that are no longer permitted are paused.
+func TestScheduleRestore(t *testing.T) {
+	backend := newMemoryBackend()
+	ss := newScheduleStore(backend)
+	req := scanRequest{ips: []string{"10.0.0.1"}, port: "4430", priority: scan.PriorityBatch}
+	s, err := newSchedule(scan.ScheduleRequest{Cron: "*/5 * * * *"}, req, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	ss.add(s)
+	s.pause()
+	ss.save(s)
+	active, err := newSchedule(scan.ScheduleRequest{Interval: "1h"}, req, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	ss.add(active)
+	denied, err := newSchedule(scan.ScheduleRequest{Interval: "1h"},
+		scanRequest{ips: []string{"10.0.0.1", "127.0.0.1"}, port: "4430"}, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	ss.add(denied)
+
+	restored := newScheduleStore(backend)
+	if err := restored.restore(); err != nil {
+		t.Fatalf("Error restoring schedules: %+v", err)
+	}
+	rs, ok := restored.get(s.id)
+	if !ok {
+		t.Fatalf("Schedule %s was not restored", s.id)
+	}
+	if sched := rs.snapshot(false); !sched.Paused || sched.Cron != "*/5 * * * *" || rs.req.priority != scan.PriorityBatch {
+		t.Errorf("Unexpected restored schedule: %+v", sched)
+	}
+	if rs, ok := restored.get(active.id); !ok || rs.snapshot(false).Paused {
+		t.Errorf("Permitted schedule %s was not restored active", active.id)
+	}
+	if rs, ok := restored.get(denied.id); !ok || !rs.snapshot(false).Paused {
+		t.Errorf("Schedule %s with targets that are not permitted was not paused", denied.id)
+	}
+
+	// Saving a deleted schedule, I.E. at the end of a run, does not write it back.
+	for _, id := range []string{s.id, active.id, denied.id} {
+		ss.delete(id)
+	}
+	ss.save(s)
+	if recs, _ := backend.loadSchedules(); len(recs) != 0 {
+		t.Errorf("Deleted schedule was not removed from the backend: %+v", recs)
+	}
+}
+
+// TestV2Schedules validates the status codes of the schedules API.
+func TestV2Schedules(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+
+	tests := []v2Test{
+		{http.MethodPost, v2SchedulesPath, `{"Interval":"1h","Scan":{"IPs":["8.8.8.8"],"Port":"65536"}}`, http.StatusBadRequest},
+		{http.MethodPost, v2SchedulesPath, `{"Cron":"* *","Scan":{"IPs":["8.8.8.8"],"Port":"443"}}`, http.StatusBadRequest},
+		{http.MethodPost, v2SchedulesPath, `{"Scan":{"IPs":["8.8.8.8"],"Port":"443"}}`, http.StatusBadRequest},
+		{http.MethodPost, v2SchedulesPath, `{"Interval":"1h","Scan":{"IPs":["127.0.0.1"],"Port":"443"}}`, http.StatusForbidden},
+		{http.MethodPut, v2SchedulesPath, ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, v2SchedulesPath + "/not_an_id", ``, http.StatusNotFound},
+		{http.MethodPost, v2SchedulesPath + "/not_an_id/" + cmdPause, ``, http.StatusNotFound},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+
+	status, body := doV2(t, ts, http.MethodPost, v2SchedulesPath,
+		`{"Cron":"0 2 * * *","Scan":{"IPs":["8.8.8.8"],"Port":"443","Priority":"batch"}}`)
+	sched := scan.Schedule{}
+	if status != http.StatusCreated || json.Unmarshal(body, &sched) != nil || sched.ID == "" || sched.NextRun.IsZero() {
+		t.Fatalf("Unexpected response creating a schedule, status: %d, body: %s", status, body)
+	}
+	path := v2SchedulesPath + "/" + sched.ID
+	tests = []v2Test{
+		{http.MethodGet, path, ``, http.StatusOK},
+		{http.MethodPost, path + "/" + cmdResume, ``, http.StatusConflict},
+		{http.MethodPost, path + "/" + cmdPause, ``, http.StatusOK},
+		{http.MethodPost, path + "/" + cmdPause, ``, http.StatusConflict},
+		{http.MethodGet, path + "/" + cmdPause, ``, http.StatusMethodNotAllowed},
+		{http.MethodPost, path + "/" + cmdResume, ``, http.StatusOK},
+		{http.MethodDelete, path, ``, http.StatusNoContent},
+		{http.MethodGet, path, ``, http.StatusNotFound},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+}
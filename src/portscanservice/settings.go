@@ -0,0 +1,60 @@
+package main
+
+// settings.go applies the per request overrides of the settings of a profile (the setthreads,
+// settimeout, setretries and setrate query keys, and the matching scan.Request fields), within the
+// limits set by the operator with the maxthreads, mintimeout, maxtimeout, maxretries and maxrate
+// flags. Profiles are chosen by the operator, so are not subject to the limits.
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// settingsKeys are the query keys that override a setting; the setting is the key without the
+// "set" prefix.
+var settingsKeys = []string{cmdSetthreads, cmdSettimeout, cmdSetretries, cmdSetrate}
+
+// applyOverrides returns s with the overrides in sr applied. On error, status is the HTTP status to
+// return: 400 for an invalid value, including a rate outside scan.MinRate to scan.MaxRate whether
+// or not the maxrate flag is set, or 403 for a value outside the operator limits.
+func applyOverrides(s scan.Settings, sr scan.Request) (scan.Settings, int, error) {
+	overrides := []struct {
+		name  string
+		value string
+	}{{"threads", sr.Threads}, {"timeout", sr.Timeout}, {"retries", sr.Retries}, {"rate", sr.Rate}}
+	for _, o := range overrides {
+		if o.value == "" {
+			continue
+		}
+		var err error
+		s, err = s.Override(o.name, o.value)
+		if err != nil {
+			return scan.Settings{}, http.StatusBadRequest, err
+		}
+		if err := permittedSetting(s, o.name); err != nil {
+			return scan.Settings{}, http.StatusForbidden, err
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return scan.Settings{}, http.StatusBadRequest, err
+	}
+	return s, http.StatusOK, nil
+}
+
+// permittedSetting returns an error if the named setting of s is outside the operator limits.
+func permittedSetting(s scan.Settings, name string) error {
+	switch {
+	case name == "threads" && s.Threads > *maxThreads:
+		return fmt.Errorf("threads %d is more than the limit of %d set by the operator", s.Threads, *maxThreads)
+	case name == "timeout" && (s.Timeout < *minTimeout || s.Timeout > *maxTimeout):
+		return fmt.Errorf("timeout %s is outside the limits of %s to %s set by the operator", s.Timeout, *minTimeout, *maxTimeout)
+	case name == "retries" && s.Retries > *maxRetries:
+		return fmt.Errorf("retries %d is more than the limit of %d set by the operator", s.Retries, *maxRetries)
+	case name == "rate" && *maxRate > 0 && (s.Rate == 0 || s.Rate > *maxRate):
+		return fmt.Errorf("rate %g is more than the limit of %g probes/s set by the operator; 0 (unlimited) is not allowed",
+			s.Rate, *maxRate)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+type overrideTest struct {
+	sr       scan.Request
+	status   int
+	expected scan.Settings
+}
+
+// TestApplyOverrides validates overrides of the settings of a profile, and the operator limits.
+func TestApplyOverrides(t *testing.T) {
+	defer func(threads int, rate float64) { *maxThreads, *maxRate = threads, rate }(*maxThreads, *maxRate)
+	*maxThreads, *maxRate = 50, 100
+
+	gentle := scan.Profiles["gentle"]
+	tests := []overrideTest{
+		{scan.Request{}, http.StatusOK, gentle},
+		{scan.Request{Threads: "50", Timeout: "500ms", Retries: "0", Rate: "100"}, http.StatusOK,
+			scan.Settings{Threads: 50, Timeout: 500 * time.Millisecond, Retries: 0, Rate: 100}},
+		{scan.Request{Timeout: "3"}, http.StatusOK,
+			scan.Settings{Threads: gentle.Threads, Timeout: 3 * time.Second, Retries: gentle.Retries, Rate: gentle.Rate}},
+		{scan.Request{Threads: "many"}, http.StatusBadRequest, scan.Settings{}},
+		{scan.Request{Retries: "-1"}, http.StatusBadRequest, scan.Settings{}},
+		{scan.Request{Threads: "51"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Timeout: "10ms"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Timeout: "1m"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Retries: "6"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Rate: "0"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Rate: "101"}, http.StatusForbidden, scan.Settings{}},
+		{scan.Request{Rate: "2e9"}, http.StatusBadRequest, scan.Settings{}},
+	}
+	checkOverrides(t, gentle, tests)
+
+	// Without a maxrate the range of the rate is still validated.
+	*maxRate = 0
+	tests = []overrideTest{
+		{scan.Request{Rate: "0"}, http.StatusOK,
+			scan.Settings{Threads: gentle.Threads, Timeout: gentle.Timeout, Retries: gentle.Retries, Rate: 0}},
+		{scan.Request{Rate: "2e9"}, http.StatusBadRequest, scan.Settings{}},
+		{scan.Request{Rate: "1e-12"}, http.StatusBadRequest, scan.Settings{}},
+		{scan.Request{Rate: "NaN"}, http.StatusBadRequest, scan.Settings{}},
+	}
+	checkOverrides(t, gentle, tests)
+}
+
+// checkOverrides applies the overrides of each test to s, and validates the result.
+func checkOverrides(t *testing.T, s scan.Settings, tests []overrideTest) {
+	for _, v := range tests {
+		o, status, err := applyOverrides(s, v.sr)
+		if status != v.status || (err == nil) != (v.status == http.StatusOK) || o != v.expected {
+			t.Errorf("Unexpected result for %+v, settings: %s, status: %d, error: %+v", v.sr, o, status, err)
+		}
+	}
+}
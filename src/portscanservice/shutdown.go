@@ -0,0 +1,68 @@
+package main
+
+// shutdown.go shuts the service down gracefully on SIGTERM (I.E. docker-compose down) or SIGINT.
+// New scans are rejected with status 503 Service Unavailable and schedules stop starting runs,
+// while running scans are given the shutdowngrace period to finish; results can still be read
+// meanwhile. Scans that are not done by then are stopped once probes in flight complete; they, and
+// queued and paused scans, are saved so they are resumed after a restart (only with the storedir
+// flag; otherwise they are lost). Webhook deliveries in progress are given what remains of the
+// grace period, and the HTTP server is stopped. A second signal exits at once.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// shutdownHTTPTimeout limits the time waiting for requests in progress, I.E. event streams of scans
+// that were not done, once scans are drained.
+const shutdownHTTPTimeout = 5 * time.Second
+
+// shutdownStopTimeout limits the time waiting for scans to stop once the grace period is over,
+// I.E. for probes in flight.
+const shutdownStopTimeout = 5 * time.Second
+
+// shutdown drains the scheduler, waiting up to grace for running scans to finish, stops those that
+// did not, saves the scans that are not done, waits for webhook deliveries for the rest of grace,
+// and then stops server.
+func shutdown(server *http.Server, grace time.Duration) {
+	fmt.Printf("INFO: %s shutting down; running scans have %s to finish.\n", scan.ServiceAppName, grace)
+	deadline := time.Now().Add(grace)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	drained := scheduler.drain()
+	select {
+	case <-drained:
+		fmt.Printf("INFO: running scans finished.\n")
+	case <-timer.C:
+		n := jobs.interrupt()
+		fmt.Printf("WARNING: %d running scans did not finish within %s; stopping them.\n", n, grace)
+		select {
+		case <-drained:
+		case <-time.After(shutdownStopTimeout):
+			fmt.Printf("WARNING: running scans did not stop within %s.\n", shutdownStopTimeout)
+		}
+	}
+
+	if n := jobs.checkpoint(); n > 0 {
+		fmt.Printf("INFO: saved %d scans that were not done, to resume after a restart.\n", n)
+		if *storeDir == "" {
+			fmt.Printf("WARNING: the scans that were not done are lost, as the storedir flag was not set.\n")
+		}
+	}
+
+	if !waitDeliveries(time.Until(deadline)) {
+		fmt.Printf("WARNING: webhook deliveries in progress did not finish within %s; they are lost.\n", grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownHTTPTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("WARNING: closing requests in progress, error: %+v\n", err)
+		server.Close()
+	}
+	fmt.Printf("INFO: shutdown complete.\n")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestShutdown validates that a drained scheduler rejects scans, that scans still running after the
+// grace period are stopped without finishing, and that scans that are not done are saved.
+func TestShutdown(t *testing.T) {
+	defaultScheduler, defaultJobs := scheduler, jobs
+	// With no workers, running does not finish until it is cancelled.
+	scheduler = newJobScheduler(0, 1, 1)
+	jobs = newJobStore(1<<20, time.Hour, newMemoryBackend())
+	defer func() {
+		scheduler, jobs = defaultScheduler, defaultJobs
+		reopenDeliveries()
+	}()
+
+	req := scanRequest{ips: []string{"127.0.0.1"}, port: "4430", priority: scan.PriorityInteractive}
+	req.settings.Threads, req.settings.Timeout = 1, 100*time.Millisecond
+	running, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	queued, err := newJob(req)
+	if err != nil {
+		t.Fatalf("Error creating job: %+v", err)
+	}
+	if scheduler.submit(running) != nil || scheduler.submit(queued) != nil {
+		t.Fatalf("Error submitting jobs")
+	}
+
+	drained := scheduler.drain()
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+	if status, body := doV2(t, ts, http.MethodPost, v2ScansPath, `{"IPs":["8.8.8.8"],"Port":"443"}`); status != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected response while shutting down, status: %d, body: %s", status, body)
+	}
+	resp, err := http.Get(ts.URL + "?setips=8.8.8.8&setport=443")
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status while shutting down: %d", resp.StatusCode)
+	}
+
+	select {
+	case <-drained:
+		t.Errorf("Drained with a job running")
+	default:
+	}
+	shutdown(ts.Config, 100*time.Millisecond)
+	select {
+	case <-drained:
+	default:
+		t.Errorf("Not drained once the running job was stopped")
+	}
+	if n := jobs.checkpoint(); n != 2 {
+		t.Errorf("Unexpected number of jobs not done: %d", n)
+	}
+	if resp, err := http.Get(ts.URL + "?status=" + running.id); err == nil {
+		resp.Body.Close()
+		t.Errorf("Server was not stopped, status: %d", resp.StatusCode)
+	}
+
+	if sj := running.snapshot(true); sj.State != scan.JobRunning || len(sj.Results) != 1 {
+		t.Errorf("Unexpected running job once stopped: %+v", sj)
+	}
+	if sj := queued.snapshot(false); sj.State != scan.JobQueued {
+		t.Errorf("Queued job was started while draining: %+v", sj)
+	}
+}
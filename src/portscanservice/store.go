@@ -0,0 +1,249 @@
+package main
+
+// store.go retains jobs. Reading a job does not remove it; done jobs are removed when their TTL
+// expires, when they are deleted, or, oldest first, when the results of all done jobs exceed the
+// size limit. Jobs are written through to a jobBackend, and restored from it on startup.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// jobStore holds jobs by ID.
+type jobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*job
+	// size is the estimated size, in bytes, of the results of all done jobs.
+	size int
+
+	// maxBytes limits size; the most recently done job is always kept.
+	maxBytes int
+	// defaultTTL is the time done jobs are kept when the request did not specify a TTL.
+	defaultTTL time.Duration
+	// backend persists jobs when they are added and when they are done.
+	backend jobBackend
+}
+
+// resultOverheadBytes is added to the length of the strings in each result to estimate its size.
+const resultOverheadBytes = 64
+
+// interruptedError is the error of jobs that were not done when the service stopped, and could
+// not be resumed.
+const interruptedError = "interrupted by a service restart"
+
+// newJobStore returns an empty jobStore persisting jobs to backend. Call restore to add the jobs in
+// backend.
+func newJobStore(maxBytes int, defaultTTL time.Duration, backend jobBackend) *jobStore {
+	return &jobStore{jobs: make(map[string]*job), maxBytes: maxBytes, defaultTTL: defaultTTL, backend: backend}
+}
+
+// add adds j to the store. A job with the same ID is not replaced.
+func (js *jobStore) add(j *job) error {
+	js.mu.Lock()
+	if _, ok := js.jobs[j.id]; ok {
+		js.mu.Unlock()
+		return fmt.Errorf("job %s already exists", j.id)
+	}
+	js.jobs[j.id] = j
+	js.mu.Unlock()
+	js.save(j)
+	return nil
+}
+
+// save writes j to the backend; errors are logged, as the job is still available from memory.
+// Saves of the same job are serialized, and each writes the job as of when it started.
+func (js *jobStore) save(j *job) {
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+	if err := js.backend.save(j.record()); err != nil {
+		fmt.Printf("ERROR: saving job %s, error: %+v\n", j.id, err)
+	}
+}
+
+// restore adds the jobs in the backend that have not expired, and returns the jobs that were not
+// done when the service stopped, to be resumed.
+func (js *jobStore) restore() ([]*job, error) {
+	recs, err := js.backend.load()
+	if err != nil {
+		return nil, err
+	}
+	interrupted := []*job{}
+	now := time.Now()
+	restored := 0
+	for _, rec := range recs {
+		j := jobFromRecord(rec)
+		if j.expired(now) {
+			js.backend.remove(j.id)
+			continue
+		}
+		restored++
+		if !rec.Job.Done() {
+			interrupted = append(interrupted, j)
+		} else {
+			j.size = resultsSize(j.results)
+		}
+		js.mu.Lock()
+		js.jobs[j.id] = j
+		js.size += j.size
+		js.mu.Unlock()
+	}
+	fmt.Printf("INFO: restored %d jobs, %d were not done.\n", restored, len(interrupted))
+	return interrupted, nil
+}
+
+// get returns the job with the specified ID, unless it has expired.
+func (js *jobStore) get(id string) (*job, bool) {
+	js.mu.RLock()
+	j, ok := js.jobs[id]
+	js.mu.RUnlock()
+	if !ok || j.expired(time.Now()) {
+		return nil, false
+	}
+	return j, true
+}
+
+// delete removes the job with the specified ID.
+func (js *jobStore) delete(id string) {
+	js.mu.Lock()
+	js.deleteLocked(id)
+	js.mu.Unlock()
+}
+
+// deleteLocked removes the job with the specified ID; js.mu must be held.
+func (js *jobStore) deleteLocked(id string) {
+	j, ok := js.jobs[id]
+	if !ok {
+		return
+	}
+	j.mu.Lock()
+	js.size -= j.size
+	j.mu.Unlock()
+	delete(js.jobs, id)
+	if err := js.backend.remove(id); err != nil {
+		fmt.Printf("ERROR: removing job %s, error: %+v\n", id, err)
+	}
+}
+
+// list returns all jobs that have not expired, oldest first, without results.
+func (js *jobStore) list() []scan.Job {
+	now := time.Now()
+	js.mu.RLock()
+	out := make([]scan.Job, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		if !j.expired(now) {
+			out = append(out, j.snapshot(false))
+		}
+	}
+	js.mu.RUnlock()
+	sort.Slice(out, func(i, k int) bool {
+		if out[i].Created.Equal(out[k].Created) {
+			return out[i].ID < out[k].ID
+		}
+		return out[i].Created.Before(out[k].Created)
+	})
+	return out
+}
+
+// retain is called when j is done. It sets the expiry and size of j, then removes expired jobs
+// and, oldest first, done jobs other than j until the store is within maxBytes.
+func (js *jobStore) retain(j *job) {
+	j.mu.Lock()
+	ttl := j.req.ttl
+	if ttl == 0 {
+		ttl = js.defaultTTL
+	}
+	j.expires = j.finished.Add(ttl)
+	j.size = resultsSize(j.results)
+	size := j.size
+	j.mu.Unlock()
+	js.save(j)
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.size += size
+	js.expireLocked(time.Now())
+	if js.size <= js.maxBytes {
+		return
+	}
+
+	done := []scan.Job{}
+	for _, dj := range js.jobs {
+		if sj := dj.snapshot(false); sj.Done() && sj.ID != j.id {
+			done = append(done, sj)
+		}
+	}
+	sort.Slice(done, func(i, k int) bool { return done[i].Finished.Before(done[k].Finished) })
+	for i := 0; i < len(done) && js.size > js.maxBytes; i++ {
+		js.deleteLocked(done[i].ID)
+	}
+}
+
+// checkpoint saves the jobs that are not done, so they are resumed after a restart, and returns
+// the number saved.
+func (js *jobStore) checkpoint() int {
+	js.mu.RLock()
+	notDone := []*job{}
+	for _, j := range js.jobs {
+		if !j.snapshot(false).Done() {
+			notDone = append(notDone, j)
+		}
+	}
+	js.mu.RUnlock()
+
+	for _, j := range notDone {
+		js.save(j)
+	}
+	return len(notDone)
+}
+
+// interrupt interrupts the running jobs, and returns the number interrupted.
+func (js *jobStore) interrupt() int {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	n := 0
+	for _, j := range js.jobs {
+		if j.interrupt() {
+			n++
+		}
+	}
+	return n
+}
+
+// expire removes jobs that have expired as of now.
+func (js *jobStore) expire(now time.Time) {
+	js.mu.Lock()
+	js.expireLocked(now)
+	js.mu.Unlock()
+}
+
+// expireLocked removes jobs that have expired as of now; js.mu must be held.
+func (js *jobStore) expireLocked(now time.Time) {
+	for id, j := range js.jobs {
+		if j.expired(now) {
+			js.deleteLocked(id)
+		}
+	}
+}
+
+// expireEvery calls expire at the specified interval; it does not return.
+func (js *jobStore) expireEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		js.expire(now)
+	}
+}
+
+// resultsSize returns the estimated size of results, in bytes.
+func resultsSize(results scan.Results) int {
+	size := 0
+	for _, r := range results {
+		size += len(r.IP) + len(r.Port) + len(r.Hostname) + resultOverheadBytes
+		if r.Error != nil {
+			size += len(*r.Error)
+		}
+	}
+	return size
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// doneJob adds a completed job with the specified results to js.
+func doneJob(js *jobStore, results scan.Results, ttl time.Duration) *job {
+	id, _ := uniqueID()
+	j := &job{id: id, req: scanRequest{ttl: ttl}, state: scan.JobCompleted, created: time.Now(),
+		finished: time.Now(), results: results}
+	js.add(j)
+	js.retain(j)
+	return j
+}
+
+// TestStoreTTL validates that done jobs expire after their TTL.
+func TestStoreTTL(t *testing.T) {
+	js := newJobStore(1<<20, time.Hour, newMemoryBackend())
+	short := doneJob(js, scan.Results{}, time.Millisecond)
+	long := doneJob(js, scan.Results{}, 0)
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := js.get(short.id); ok {
+		t.Errorf("Expired job was returned")
+	}
+	if _, ok := js.get(long.id); !ok {
+		t.Errorf("Job with the default TTL was not returned")
+	}
+	js.expire(time.Now())
+	if len(js.list()) != 1 || js.size != 0 {
+		t.Errorf("Unexpected jobs after expiry: %+v, size: %d", js.list(), js.size)
+	}
+}
+
+// TestStoreAddExisting validates that a job is not replaced by another with the same ID.
+func TestStoreAddExisting(t *testing.T) {
+	js := newJobStore(1<<20, time.Hour, newMemoryBackend())
+	j := doneJob(js, scan.Results{}, 0)
+	if err := js.add(&job{id: j.id, state: scan.JobQueued}); err == nil {
+		t.Errorf("Job with an existing ID was added")
+	}
+	if got, _ := js.get(j.id); got != j {
+		t.Errorf("Job was replaced")
+	}
+}
+
+// TestStoreMaxBytes validates that the oldest done jobs are removed when over the size limit.
+func TestStoreMaxBytes(t *testing.T) {
+	none := scan.NoError
+	results := scan.Results{{IP: "127.0.0.1", Port: "443", Error: &none}}
+	size := resultsSize(results)
+	js := newJobStore(2*size, time.Hour, newMemoryBackend())
+	first := doneJob(js, results, 0)
+	second := doneJob(js, results, 0)
+	third := doneJob(js, results, 0)
+	if _, ok := js.get(first.id); ok {
+		t.Errorf("Oldest job was not removed")
+	}
+	for _, j := range []*job{second, third} {
+		if _, ok := js.get(j.id); !ok {
+			t.Errorf("Newer job was removed")
+		}
+	}
+	if js.size != 2*size {
+		t.Errorf("Unexpected store size: %d", js.size)
+	}
+}
+
+// TestDeleteQuery validates explicit deletion using the query string API.
+func TestDeleteQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handlerIndex))
+	defer ts.Close()
+
+	j := doneJob(jobs, scan.Results{}, 0)
+	for _, status := range []int{http.StatusOK, http.StatusBadRequest} {
+		resp, err := http.Get(ts.URL + "?delete=" + j.id)
+		if err != nil {
+			t.Fatalf("Error from get, error: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Unexpected status for delete: %d, expected: %d", resp.StatusCode, status)
+		}
+	}
+
+	running, _ := newJob(scanRequest{})
+	resp, err := http.Get(ts.URL + "?delete=" + running.id)
+	if err != nil {
+		t.Fatalf("Error from get, error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Unexpected status for delete of a job that is not done: %d", resp.StatusCode)
+	}
+	jobs.delete(running.id)
+}
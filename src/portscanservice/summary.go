@@ -0,0 +1,36 @@
+package main
+
+// summary.go summarizes the results of a job, for the summary query and GET
+// /v2/scans/{id}/summary; see scan.Summary.
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// v2Summary is the path segment, following a scan ID, of the summary.
+const v2Summary = "summary"
+
+// summarize returns the summary of the results of sj, a snapshot including results. A job that is
+// not done is summarized up to now, and the partial headers are set on w.
+func summarize(w http.ResponseWriter, sj scan.Job) scan.Summary {
+	s := scan.Summarize(sj.Results, sj.Started, sj.Finished)
+	s.ID, s.Partial = sj.ID, sj.Partial
+	if sj.Partial {
+		w.Header().Set(scan.PartialHeader, "true")
+		w.Header().Set(scan.PercentHeader, fmt.Sprintf("%.1f", sj.Percent))
+	}
+	return s
+}
+
+// v2GetSummary writes the summary of the results of the scan with the specified ID.
+func v2GetSummary(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("ID %s was not a recognized ID", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, summarize(w, j.snapshot(true)))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// TestSummary validates the summary from the query string and v2 APIs.
+func TestSummary(t *testing.T) {
+	ts := httptest.NewServer(newServeMux())
+	defer ts.Close()
+	j := doneJob(jobs, filterResults(), 0)
+
+	for _, path := range []string{"/?summary=" + j.id, v2ScansPath + "/" + j.id + "/" + v2Summary} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Error from get, error: %+v", err)
+		}
+		s := scan.Summary{}
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected response for %s, status: %d, error: %+v", path, resp.StatusCode, err)
+			continue
+		}
+		if s.ID != j.id || s.Partial || s.Results != 7 || s.States[scan.StateOpen] != 3 || len(s.OpenHosts) != 3 ||
+			s.Errors[scan.ErrorRefused] != 2 || s.Errors[scan.ErrorTimeout] != 2 {
+			t.Errorf("Unexpected summary for %s: %+v", path, s)
+		}
+	}
+
+	tests := []v2Test{
+		{http.MethodGet, "/?summary=" + j.id + "&setport=22", ``, http.StatusBadRequest},
+		{http.MethodGet, "/?summary=not-an-id", ``, http.StatusBadRequest},
+		{http.MethodGet, v2ScansPath + "/not-an-id/" + v2Summary, ``, http.StatusNotFound},
+		{http.MethodPost, v2ScansPath + "/" + j.id + "/" + v2Summary, ``, http.StatusMethodNotAllowed},
+	}
+	for _, v := range tests {
+		if status, body := doV2(t, ts, v.method, v.path, v.body); status != v.status {
+			t.Errorf("Unexpected response for %+v, status: %d, body: %s", v, status, body)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+// webhooks.go POSTs a scan.WebhookEvent to the webhook of a job when it is done, and to the webhook
+// of its schedule when a run is done or finds ports that changed state since the previous
+// completed run. Deliveries are retried with exponential backoff, and signed with the webhook
+// secret, so receivers can verify they came from this service.
+// So that clients cannot use webhooks to reach hosts they may not scan, I.E. cloud metadata or
+// internal services, every address of a webhook host must be permitted by the target policy; this
+// is checked when the webhook is given, and again for each connection, as DNS can change. Redirects
+// are not followed.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// webhookResolveTimeout limits the time resolving the host of a webhook when it is validated.
+const webhookResolveTimeout = 5 * time.Second
+
+var (
+	// webhookClient sends deliveries; the timeout is per attempt. It connects only to permitted
+	// addresses, and does not use a proxy, as the proxy address is not the webhook host.
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialWebhook,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errWebhookRedirect
+		},
+	}
+	// webhookBackoff is the delay before the first retry of a delivery; it doubles for each retry.
+	webhookBackoff = time.Second
+
+	errWebhookRedirect = errors.New("webhook redirects are not followed")
+
+	// deliveries tracks deliveries in progress, so shutdown can wait for them.
+	deliveries sync.WaitGroup
+	// deliveriesClosed is set once shutdown waits for deliveries, after which none are started, as
+	// deliveries must not be added to while it is waited for. It is guarded by deliveriesMu.
+	deliveriesClosed bool
+	deliveriesMu     sync.Mutex
+)
+
+// validateWebhook returns an error if webhook is not an absolute http or https URL, or its host
+// has an address that is not permitted by the target policy.
+func validateWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("invalid webhook %s; must be an http or https URL", webhook)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookResolveTimeout)
+	defer cancel()
+	if _, err := webhookAddrs(ctx, u.Hostname()); err != nil {
+		return fmt.Errorf("invalid webhook %s; %+v", webhook, err)
+	}
+	return nil
+}
+
+// webhookAddrs resolves host, returning an error if it has an address that is not permitted by the
+// target policy.
+func webhookAddrs(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("host %s has no addresses", host)
+	}
+	for _, a := range addrs {
+		if err := policy.permitted(a.IP.String()); err != nil {
+			return nil, fmt.Errorf("host %s is not permitted, error: %+v", host, err)
+		}
+	}
+	return addrs, nil
+}
+
+// dialWebhook connects to a permitted address of the host of addr. The host is resolved and
+// checked for each connection, so that it cannot be changed to an address that is not permitted
+// after validateWebhook.
+func dialWebhook(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := webhookAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// notifyDone sends the events for j, which is done, to the webhooks of j and its schedule.
+// Deliveries are made in the background.
+func notifyDone(j *job) {
+	sj := j.snapshot(false)
+	ev := scan.WebhookEvent{Event: sj.State, Time: sj.Finished, Job: sj}
+	if j.req.webhook != "" {
+		goDeliver(j.req.webhook, ev)
+	}
+
+	if j.req.scheduleID == "" {
+		return
+	}
+	s, ok := schedules.get(j.req.scheduleID)
+	if !ok || s.sr.Webhook == "" {
+		return
+	}
+	goDeliver(s.sr.Webhook, ev)
+
+	runs := s.completedRuns()
+	if sj.State != scan.JobCompleted || len(runs) < 2 || runs[len(runs)-1] != j.id {
+		return
+	}
+	d, _, err := diffJobs(runs[len(runs)-2], j.id)
+	if err != nil {
+		fmt.Printf("ERROR: comparing runs of schedule %s, error: %+v\n", s.id, err)
+		return
+	}
+	if d.Opened+d.Closed+d.Changed > 0 {
+		goDeliver(s.sr.Webhook, scan.WebhookEvent{Event: scan.EventChanged, Time: sj.Finished, Job: sj, Diff: &d})
+	}
+}
+
+// goDeliver delivers ev to webhook in the background, tracked by deliveries. Once the service is
+// shutting down, ev is dropped.
+func goDeliver(webhook string, ev scan.WebhookEvent) {
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	if deliveriesClosed {
+		fmt.Printf("WARNING: not delivering %s event for job %s, as the service is shutting down\n", ev.Event, ev.Job.ID)
+		return
+	}
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		deliver(webhook, ev)
+	}()
+}
+
+// waitDeliveries stops deliveries being started, and waits up to timeout for deliveries in progress.
+// Returns false if they did not finish.
+func waitDeliveries(timeout time.Duration) bool {
+	deliveriesMu.Lock()
+	deliveriesClosed = true
+	deliveriesMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		deliveries.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+	// The deliveries may have finished as the timer fired.
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver POSTs ev to webhook, retrying up to webhookretries times while the receiver cannot be
+// reached or responds with status 429 or 5xx.
+func deliver(webhook string, ev scan.WebhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("ERROR: marshalling %s event for job %s, error: %+v\n", ev.Event, ev.Job.ID, err)
+		return
+	}
+	id, err := uniqueID()
+	if err != nil {
+		fmt.Printf("ERROR: creating delivery ID, error: %+v\n", err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := post(webhook, id, ev.Event, body)
+		if err == nil {
+			fmt.Printf("INFO: delivered %s event for job %s, delivery %s\n", ev.Event, ev.Job.ID, id)
+			return
+		}
+		if !retry || attempt >= *webhookRetries {
+			fmt.Printf("ERROR: delivering %s event for job %s, delivery %s, giving up after %d attempts, error: %+v\n",
+				ev.Event, ev.Job.ID, id, attempt+1, err)
+			return
+		}
+		fmt.Printf("WARNING: delivering %s event for job %s, delivery %s, retrying in %s, error: %+v\n",
+			ev.Event, ev.Job.ID, id, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt. On error, retry is true if the attempt should be retried.
+func post(webhook string, id string, event string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", scan.ServiceAppName)
+	req.Header.Set(scan.EventHeader, event)
+	req.Header.Set(scan.DeliveryHeader, id)
+	if *webhookSecret != "" {
+		req.Header.Set(scan.SignatureHeader, scan.WebhookSignature([]byte(*webhookSecret), body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status %d", resp.StatusCode)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/portscan/src/scan"
+)
+
+// delivery is a request received by a test webhook.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhook returns a test webhook that responds with statuses in turn, then 200, and sends each
+// request received to the returned channel.
+func newWebhook(statuses ...int) (*httptest.Server, chan delivery) {
+	received := make(chan delivery, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- delivery{header: r.Header, body: body}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	return ts, received
+}
+
+// TestValidateWebhook validates webhook URLs, and that their hosts are permitted.
+func TestValidateWebhook(t *testing.T) {
+	// webhookMap is a map of URL/should_pass pairs.
+	webhookMap := map[string]bool{"http://93.184.216.34/a?b=c": true, "https://10.0.0.1:8443/": true,
+		"ftp://example.com/": false, "/relative": false, "example.com": false, "http://": false, "%": false,
+		"http://127.0.0.1:8000/": false, "http://localhost/": false, "http://[::1]/": false,
+		"http://169.254.169.254/latest/meta-data/": false, "http://:8000/": false}
+	for k, v := range webhookMap {
+		if err := validateWebhook(k); (err == nil) != v {
+			t.Errorf("Webhook %q was validated incorrectly, error: %+v", k, err)
+		}
+	}
+}
+
+// TestDeliver validates retries and the headers of deliveries.
+func TestDeliver(t *testing.T) {
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { policy = defaultPolicy }()
+	defaultBackoff, defaultSecret := webhookBackoff, *webhookSecret
+	webhookBackoff, *webhookSecret = time.Millisecond, "secret"
+	defer func() { webhookBackoff, *webhookSecret = defaultBackoff, defaultSecret }()
+
+	ts, received := newWebhook(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer ts.Close()
+	ev := scan.WebhookEvent{Event: scan.EventCompleted, Job: scan.Job{ID: "deliver-id"}}
+	deliver(ts.URL, ev)
+	if len(received) != 3 {
+		t.Fatalf("Unexpected number of attempts: %d", len(received))
+	}
+	id := ""
+	for i := 0; i < 3; i++ {
+		d := <-received
+		sent := scan.WebhookEvent{}
+		if json.Unmarshal(d.body, &sent) != nil || sent.Job.ID != ev.Job.ID ||
+			d.header.Get(scan.EventHeader) != scan.EventCompleted ||
+			d.header.Get(scan.SignatureHeader) != scan.WebhookSignature([]byte("secret"), d.body) ||
+			(id != "" && d.header.Get(scan.DeliveryHeader) != id) {
+			t.Errorf("Unexpected delivery, headers: %+v, body: %s", d.header, d.body)
+		}
+		id = d.header.Get(scan.DeliveryHeader)
+	}
+
+	// Client errors are not retried.
+	ts, received = newWebhook(http.StatusBadRequest)
+	defer ts.Close()
+	deliver(ts.URL, ev)
+	if len(received) != 1 {
+		t.Errorf("Unexpected number of attempts: %d", len(received))
+	}
+}
+
+// TestNotifyDone validates the events sent to the webhooks of a job and its schedule.
+func TestNotifyDone(t *testing.T) {
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { policy = defaultPolicy }()
+	jobHook, jobReceived := newWebhook()
+	defer jobHook.Close()
+	scheduleHook, scheduleReceived := newWebhook()
+	defer scheduleHook.Close()
+
+	s, err := newSchedule(scan.ScheduleRequest{Interval: "1h", Webhook: scheduleHook.URL}, scanRequest{}, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating schedule: %+v", err)
+	}
+	schedules.add(s)
+	defer schedules.delete(s.id)
+
+	open, refused := scan.NoError, "connect: connection refused"
+	from := doneJob(jobs, scan.Results{{IP: "10.0.0.1", Port: "22", Error: &refused}}, 0)
+	to := doneJob(jobs, scan.Results{{IP: "10.0.0.1", Port: "22", Error: &open}}, 0)
+	from.req.scheduleID = s.id
+	to.req.scheduleID, to.req.webhook = s.id, jobHook.URL
+	notifyDone(to)
+
+	events := map[string]scan.WebhookEvent{}
+	for i := 0; i < 3; i++ {
+		var d delivery
+		select {
+		case d = <-jobReceived:
+		case d = <-scheduleReceived:
+			d.header.Set("Schedule", "true")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events: %+v", events)
+		}
+		ev := scan.WebhookEvent{}
+		json.Unmarshal(d.body, &ev)
+		events[d.header.Get("Schedule")+ev.Event] = ev
+	}
+	if ev, ok := events[scan.EventCompleted]; !ok || ev.Job.ID != to.id {
+		t.Errorf("Unexpected job events: %+v", events)
+	}
+	if ev, ok := events["true"+scan.EventCompleted]; !ok || ev.Job.ScheduleID != s.id {
+		t.Errorf("Unexpected schedule events: %+v", events)
+	}
+	if ev, ok := events["true"+scan.EventChanged]; !ok || ev.Diff == nil || ev.Diff.From != from.id || ev.Diff.Opened != 1 {
+		t.Errorf("Unexpected schedule events: %+v", events)
+	}
+}
+
+// TestWebhookPolicy validates that deliveries are not made to addresses, or redirected to hosts,
+// that are not permitted.
+func TestWebhookPolicy(t *testing.T) {
+	defaultBackoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = defaultBackoff }()
+
+	ts, received := newWebhook()
+	defer ts.Close()
+	if _, err := post(ts.URL, "id", scan.EventCompleted, nil); err == nil {
+		t.Errorf("Delivery to loopback was not refused")
+	}
+
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() { policy = defaultPolicy }()
+	redirect := httptest.NewServer(http.RedirectHandler(ts.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	if _, err := post(redirect.URL, "id", scan.EventCompleted, nil); err == nil {
+		t.Errorf("Redirected delivery did not fail")
+	}
+	if len(received) != 0 {
+		t.Errorf("Unexpected deliveries: %d", len(received))
+	}
+}
+
+// reopenDeliveries undoes waitDeliveries, so later tests deliver webhooks.
+func reopenDeliveries() {
+	deliveriesMu.Lock()
+	deliveriesClosed = false
+	deliveriesMu.Unlock()
+}
+
+// TestWaitDeliveries validates that deliveries in progress are waited for, up to the timeout, and
+// that deliveries are not started once waited for.
+func TestWaitDeliveries(t *testing.T) {
+	defaultPolicy := policy
+	policy, _ = newTargetPolicy([]string{"127.0.0.0/8"}, nil)
+	defer func() {
+		policy = defaultPolicy
+		reopenDeliveries()
+	}()
+
+	release := make(chan struct{})
+	var received int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		<-release
+	}))
+	defer ts.Close()
+
+	goDeliver(ts.URL, scan.WebhookEvent{Event: scan.EventCompleted, Job: scan.Job{ID: "wait-id"}})
+	if waitDeliveries(10 * time.Millisecond) {
+		t.Errorf("Delivery in progress was not waited for")
+	}
+	// Deliveries are not started once waited for.
+	goDeliver(ts.URL, scan.WebhookEvent{Event: scan.EventCompleted, Job: scan.Job{ID: "late-id"}})
+	close(release)
+	if !waitDeliveries(5 * time.Second) {
+		t.Errorf("Delivery did not finish")
+	}
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Errorf("Unexpected number of deliveries: %d", n)
+	}
+}
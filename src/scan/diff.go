@@ -0,0 +1,191 @@
+package scan
+
+// diff.go compares the results of two scans, reporting the ports that opened, closed or changed
+// state on each host.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Port states, derived from the Error of a Result.
+const (
+	// StateOpen is a port that accepted the connection.
+	StateOpen = "open"
+	// StateClosed is a port that refused the connection; the host responded.
+	StateClosed = "closed"
+	// StateFiltered is a port with no response, I.E. a timeout.
+	StateFiltered = "filtered"
+	// StateNotScanned is a target that was not probed.
+	StateNotScanned = NotScanned
+)
+
+// Kinds of PortChange.
+const (
+	// ChangeOpened is a port that is open, and was not.
+	ChangeOpened = "opened"
+	// ChangeClosed is a port that was open, and is not.
+	ChangeClosed = "closed"
+	// ChangeChanged is a port that changed between closed and filtered.
+	ChangeChanged = "changed"
+)
+
+// State returns the state of the port of r; one of the State* states.
+func (r Result) State() string {
+	switch {
+	case r.Error == nil || *r.Error == NotScanned:
+		return StateNotScanned
+	case *r.Error == NoError:
+		return StateOpen
+	case r.Responded():
+		return StateClosed
+	}
+	return StateFiltered
+}
+
+// ResultsDiff is the difference between the results of two scans, as returned by Diff.
+type ResultsDiff struct {
+	// From and To are the IDs of the scans compared, when the results are those of jobs.
+	From string `json:",omitempty"`
+	To   string `json:",omitempty"`
+	// Hosts are the hosts with a changed port, ordered by IP.
+	Hosts []HostChanges
+	// Opened, Closed and Changed count the PortChanges of each kind.
+	Opened  int
+	Closed  int
+	Changed int
+	// Unchanged is the number of targets in the same state in both scans.
+	Unchanged int
+	// Uncompared is the number of targets in only one scan, or not scanned by one of them.
+	Uncompared int
+}
+
+// HostChanges are the changed ports of a host, ordered by port.
+type HostChanges struct {
+	IP string
+	// Hostname is set if either scan looked up the hostname.
+	Hostname string `json:",omitempty"`
+	Ports    []PortChange
+}
+
+// PortChange is a port whose state changed from Before to After.
+type PortChange struct {
+	Port string
+	// Change is one of the Change* kinds.
+	Change string
+	Before string
+	After  string
+}
+
+// Diff returns the changes from the results from to the results to. Targets are matched by IP
+// and port; targets that are in only one of the results, or were not scanned in one of them,
+// cannot be compared and are only counted.
+func Diff(from Results, to Results) ResultsDiff {
+	type target struct{ ip, port string }
+	before := make(map[target]Result, len(from))
+	for _, r := range from {
+		before[target{r.IP, r.Port}] = r
+	}
+
+	d := ResultsDiff{Hosts: []HostChanges{}}
+	hosts := map[string]*HostChanges{}
+	// seen are the targets of from that are also in to.
+	seen := map[target]bool{}
+	for _, r := range to {
+		t := target{r.IP, r.Port}
+		b, ok := before[t]
+		if !ok || seen[t] || b.State() == StateNotScanned || r.State() == StateNotScanned {
+			seen[t] = ok
+			d.Uncompared++
+			continue
+		}
+		seen[t] = true
+		if b.State() == r.State() {
+			d.Unchanged++
+			continue
+		}
+
+		pc := PortChange{Port: r.Port, Change: ChangeChanged, Before: b.State(), After: r.State()}
+		switch {
+		case pc.After == StateOpen:
+			pc.Change = ChangeOpened
+			d.Opened++
+		case pc.Before == StateOpen:
+			pc.Change = ChangeClosed
+			d.Closed++
+		default:
+			d.Changed++
+		}
+		h, ok := hosts[r.IP]
+		if !ok {
+			h = &HostChanges{IP: r.IP}
+			hosts[r.IP] = h
+		}
+		if h.Hostname == "" {
+			h.Hostname = r.Hostname
+		}
+		if h.Hostname == "" {
+			h.Hostname = b.Hostname
+		}
+		h.Ports = append(h.Ports, pc)
+	}
+	for t := range before {
+		if !seen[t] {
+			d.Uncompared++
+		}
+	}
+
+	for _, h := range hosts {
+		sort.Slice(h.Ports, func(i, k int) bool { return PortLess(h.Ports[i].Port, h.Ports[k].Port) })
+		d.Hosts = append(d.Hosts, *h)
+	}
+	sort.Slice(d.Hosts, func(i, k int) bool { return IPLess(d.Hosts[i].IP, d.Hosts[k].IP) })
+	return d
+}
+
+// IPLess returns true if IP a orders before b, numerically; strings that are not IPs sort after
+// IPs, as strings. IPv6 addresses may be bracketed, as in Results.
+func IPLess(a string, b string) bool {
+	ipa, ipb := net.ParseIP(strings.Trim(a, "[]")), net.ParseIP(strings.Trim(b, "[]"))
+	if ipa == nil || ipb == nil {
+		if ipa == nil && ipb == nil {
+			return a < b
+		}
+		return ipb == nil
+	}
+	return bytes.Compare(ipa.To16(), ipb.To16()) < 0
+}
+
+// PortLess returns true if port a orders before b, numerically.
+func PortLess(a string, b string) bool {
+	pa, erra := strconv.Atoi(a)
+	pb, errb := strconv.Atoi(b)
+	if erra != nil || errb != nil {
+		return a < b
+	}
+	return pa < pb
+}
+
+func (d ResultsDiff) String() string {
+	out := ""
+	if d.From != "" || d.To != "" {
+		out += fmt.Sprintf("From: %s, To: %s\n", d.From, d.To)
+	}
+	out += fmt.Sprintf("Opened: %d, Closed: %d, Changed: %d, Unchanged: %d, Not compared: %d\n",
+		d.Opened, d.Closed, d.Changed, d.Unchanged, d.Uncompared)
+	for _, h := range d.Hosts {
+		host := fmt.Sprintf("IP:  %-15s| ", h.IP)
+		if h.Hostname != "" {
+			host += fmt.Sprintf("Host: %-30s| ", h.Hostname)
+		}
+		for _, p := range h.Ports {
+			out += fmt.Sprintf("%sPort: %-5s| %-7s (%s -> %s)\n", host, p.Port, strings.ToUpper(p.Change),
+				p.Before, p.After)
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package scan
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestResultState validates the state derived from the Error of results.
+func TestResultState(t *testing.T) {
+	// stateMap is a map of Error/state pairs.
+	stateMap := map[string]string{NoError: StateOpen, NotScanned: StateNotScanned,
+		"dial tcp 10.0.0.1:22: connect: connection refused": StateClosed,
+		"dial tcp 10.0.0.1:22: i/o timeout":                 StateFiltered}
+	for k, v := range stateMap {
+		e := k
+		if state := (Result{Error: &e}).State(); state != v {
+			t.Errorf("Unexpected state for error %q: %s, expected: %s", k, state, v)
+		}
+	}
+	if state := (Result{}).State(); state != StateNotScanned {
+		t.Errorf("Unexpected state for a result with no error: %s", state)
+	}
+}
+
+// TestDiff validates the changes between two sets of results.
+func TestDiff(t *testing.T) {
+	open, refused, timeout, ns := NoError, "connect: connection refused", "i/o timeout", NotScanned
+	from := Results{
+		{IP: "10.0.0.10", Port: "443", Error: &open},
+		{IP: "10.0.0.10", Port: "80", Error: &refused},
+		{IP: "10.0.0.2", Port: "22", Error: &refused},
+		{IP: "10.0.0.2", Port: "443", Error: &open},
+		{IP: "10.0.0.3", Port: "22", Error: &timeout},
+		{IP: "10.0.0.4", Port: "22", Error: &ns},
+		{IP: "10.0.0.5", Port: "22", Error: &open},
+	}
+	to := Results{
+		{IP: "10.0.0.10", Port: "443", Error: &timeout, Hostname: "web"},
+		{IP: "10.0.0.10", Port: "80", Error: &open},
+		{IP: "10.0.0.2", Port: "22", Error: &open},
+		{IP: "10.0.0.2", Port: "443", Error: &open},
+		{IP: "10.0.0.3", Port: "22", Error: &refused},
+		{IP: "10.0.0.4", Port: "22", Error: &open},
+		{IP: "10.0.0.6", Port: "22", Error: &open},
+	}
+	d := Diff(from, to)
+	if d.Opened != 2 || d.Closed != 1 || d.Changed != 1 || d.Unchanged != 1 || d.Uncompared != 3 {
+		t.Errorf("Unexpected counts: %+v", d)
+	}
+	if len(d.Hosts) != 3 || d.Hosts[0].IP != "10.0.0.2" || d.Hosts[1].IP != "10.0.0.3" || d.Hosts[2].IP != "10.0.0.10" {
+		t.Fatalf("Unexpected hosts: %+v", d.Hosts)
+	}
+	web := d.Hosts[2]
+	if web.Hostname != "web" || len(web.Ports) != 2 ||
+		web.Ports[0] != (PortChange{Port: "80", Change: ChangeOpened, Before: StateClosed, After: StateOpen}) ||
+		web.Ports[1] != (PortChange{Port: "443", Change: ChangeClosed, Before: StateOpen, After: StateFiltered}) {
+		t.Errorf("Unexpected host changes: %+v", web)
+	}
+	if d.Hosts[1].Ports[0].Change != ChangeChanged {
+		t.Errorf("Unexpected host changes: %+v", d.Hosts[1])
+	}
+	if s := d.String(); !strings.Contains(s, "Opened: 2, Closed: 1") || strings.Count(s, "\n") != 5 {
+		t.Errorf("Unexpected string:\n%s", s)
+	}
+
+	if d := Diff(from, from); d.Opened+d.Closed+d.Changed != 0 || len(d.Hosts) != 0 || d.Unchanged != 6 {
+		t.Errorf("Unexpected diff of the same results: %+v", d)
+	}
+}
+
+// TestIPLess validates the order of IPs, including bracketed IPv6 addresses.
+func TestIPLess(t *testing.T) {
+	ips := []string{"[2001:db8::1]", "not-an-ip", "10.0.0.10", "[::1]", "2001:db8::2", "10.0.0.2"}
+	sort.Slice(ips, func(i, k int) bool { return IPLess(ips[i], ips[k]) })
+	expected := []string{"[::1]", "10.0.0.2", "10.0.0.10", "[2001:db8::1]", "2001:db8::2", "not-an-ip"}
+	for i := range ips {
+		if ips[i] != expected[i] {
+			t.Errorf("Unexpected order: %+v, expected: %+v", ips, expected)
+			break
+		}
+	}
+}
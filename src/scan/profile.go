@@ -0,0 +1,185 @@
+package scan
+
+// profile.go provides Settings, the tunables for a scan, and named profiles that bundle them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings are the tunables for a scan.
+type Settings struct {
+	// Threads is the number of probes run concurrently.
+	Threads int
+	// Timeout is the connect timeout for each probe.
+	Timeout time.Duration
+	// Retries is the number of times a probe is retried when the connection fails for a reason
+	// other than being refused.
+	Retries int
+	// Rate is the maximum number of probes started per second; 0 for no limit.
+	Rate float64
+	// Limiter, if not nil, shares connection attempts with other scans. It is not part of the JSON
+	// representation.
+	Limiter Limiter
+}
+
+// settingsJSON is the JSON representation of Settings; Timeout is a duration string (I.E. "2s").
+type settingsJSON struct {
+	Threads int
+	Timeout string
+	Retries int
+	Rate    float64
+}
+
+const (
+	// DefaultProfile is the profile used when none is specified.
+	DefaultProfile = "normal"
+
+	InvalidProfile  = "Invalid profile entry. Must be one of: "
+	InvalidSettings = "Invalid settings. Threads must be >= 1, timeout > 0, retries >= 0 and rate 0 (unlimited) or from 1e-09 to 1e+09."
+
+	// MinRate and MaxRate are the limits of a Rate that is set; the interval between probes must be
+	// from 1ns to the longest time.Duration.
+	MinRate = 1e-9
+	MaxRate = 1e9
+)
+
+// Profiles are the built in profiles. Use LoadProfiles to add user defined profiles.
+var Profiles = map[string]Settings{
+	"gentle":         {Threads: 2, Timeout: 5 * time.Second, Retries: 2, Rate: 10},
+	"normal":         {Threads: 10, Timeout: 2 * time.Second, Retries: 0, Rate: 0},
+	"aggressive-lan": {Threads: 100, Timeout: 250 * time.Millisecond, Retries: 0, Rate: 0},
+}
+
+// LoadProfiles returns the built in Profiles plus the profiles defined in the JSON file at path;
+// a user defined profile replaces a built in profile with the same name. The file is an object of
+// profile names to settings. Example:
+// {"slow-wan": {"Threads": 5, "Timeout": "10s", "Retries": 3, "Rate": 20}}
+// Settings omitted from a user defined profile are taken from DefaultProfile. Profile names are
+// converted to lower case, as the CLI and service inputs are case insensitive.
+func LoadProfiles(path string) (map[string]Settings, error) {
+	profiles := make(map[string]Settings)
+	for k, v := range Profiles {
+		profiles[k] = v
+	}
+	if path == "" {
+		return profiles, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles file %s, error: %+v", path, err)
+	}
+	userProfiles := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &userProfiles); err != nil {
+		return nil, fmt.Errorf("parsing profiles file %s, error: %+v", path, err)
+	}
+	for k, v := range userProfiles {
+		s := Profiles[DefaultProfile]
+		if err := json.Unmarshal(v, &s); err != nil {
+			return nil, fmt.Errorf("parsing profile %s in file %s, error: %+v", k, path, err)
+		}
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("profile %s in file %s, error: %+v", k, path, err)
+		}
+		profiles[strings.ToLower(k)] = s
+	}
+	return profiles, nil
+}
+
+// ProfileNames returns the sorted names of profiles.
+func ProfileNames(profiles map[string]Settings) []string {
+	names := make([]string, 0, len(profiles))
+	for k := range profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateProfile returns the settings for the named profile.
+func ValidateProfile(profiles map[string]Settings, name string) (Settings, error) {
+	s, ok := profiles[name]
+	if !ok {
+		return Settings{}, fmt.Errorf("%s%+v", InvalidProfile, ProfileNames(profiles))
+	}
+	return s, nil
+}
+
+// Override returns s with the named setting (threads, timeout, retries or rate) set to value,
+// and validated. Timeout is a duration (I.E. 500ms) or integer seconds.
+func (s Settings) Override(name string, value string) (Settings, error) {
+	var err error
+	switch name {
+	case "threads":
+		s.Threads, err = strconv.Atoi(value)
+	case "timeout":
+		s.Timeout, err = ParseDuration(value)
+	case "retries":
+		s.Retries, err = strconv.Atoi(value)
+	case "rate":
+		s.Rate, err = strconv.ParseFloat(value, 64)
+	default:
+		return Settings{}, fmt.Errorf("unknown setting: %s", name)
+	}
+	if err != nil {
+		return Settings{}, fmt.Errorf("%s invalid %s: %s", InvalidSettings, name, value)
+	}
+	if err := s.Validate(); err != nil {
+		return Settings{}, err
+	}
+	return s, nil
+}
+
+// Validate returns an error if any setting is out of range.
+func (s Settings) Validate() error {
+	if s.Threads < 1 || s.Timeout <= 0 || s.Retries < 0 || !(s.Rate == 0 || (s.Rate >= MinRate && s.Rate <= MaxRate)) {
+		return fmt.Errorf("%s", InvalidSettings)
+	}
+	return nil
+}
+
+// interval returns the interval between probes for Rate, which must be > 0; it is at least 1ns.
+func (s Settings) interval() time.Duration {
+	d := float64(time.Second) / s.Rate
+	switch {
+	case d < 1:
+		return 1
+	case d >= math.MaxInt64:
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+func (s Settings) String() string {
+	rate := "unlimited"
+	if s.Rate > 0 {
+		rate = fmt.Sprintf("%g probes/s", s.Rate)
+	}
+	return fmt.Sprintf("threads: %d, timeout: %s, retries: %d, rate: %s", s.Threads, s.Timeout, s.Retries, rate)
+}
+
+// MarshalJSON writes Timeout as a duration string.
+func (s Settings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(settingsJSON{Threads: s.Threads, Timeout: s.Timeout.String(), Retries: s.Retries, Rate: s.Rate})
+}
+
+// UnmarshalJSON reads Timeout as a duration string. Fields not present are left unchanged.
+func (s *Settings) UnmarshalJSON(b []byte) error {
+	sj := settingsJSON{Threads: s.Threads, Timeout: s.Timeout.String(), Retries: s.Retries, Rate: s.Rate}
+	if err := json.Unmarshal(b, &sj); err != nil {
+		return err
+	}
+	t, err := time.ParseDuration(sj.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout %s, error: %+v", sj.Timeout, err)
+	}
+	*s = Settings{Threads: sj.Threads, Timeout: t, Retries: sj.Retries, Rate: sj.Rate}
+	return nil
+}
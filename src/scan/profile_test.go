@@ -0,0 +1,96 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLoadProfiles validates user defined profiles are added to, and override, built in profiles.
+func TestLoadProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "profiles.json")
+	ioutil.WriteFile(path, []byte(`{"slow-wan": {"Threads": 5, "Timeout": "10s", "Retries": 3, "Rate": 20},
+		"gentle": {"Threads": 1}}`), 0600)
+
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatalf("Error loading profiles: %+v", err)
+	}
+	expected := map[string]Settings{
+		"slow-wan":       {Threads: 5, Timeout: 10 * time.Second, Retries: 3, Rate: 20},
+		"gentle":         {Threads: 1, Timeout: 2 * time.Second},
+		"aggressive-lan": Profiles["aggressive-lan"],
+	}
+	for k, v := range expected {
+		if s, err := ValidateProfile(profiles, k); err != nil || s != v {
+			t.Errorf("Unexpected settings for profile %s: %+v, error: %+v", k, s, err)
+		}
+	}
+	if _, err := ValidateProfile(profiles, "missing"); err == nil {
+		t.Errorf("Missing profile was accepted!")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"bad": {"Threads": 0}}`), 0600)
+	if _, err := LoadProfiles(path); err == nil {
+		t.Errorf("Invalid profile was accepted!")
+	}
+}
+
+// TestSettingsJSON validates Settings round trip through JSON with a duration string timeout.
+func TestSettingsJSON(t *testing.T) {
+	s := Settings{Threads: 3, Timeout: 1500 * time.Millisecond, Retries: 1, Rate: 2.5}
+	b, err := json.Marshal(s)
+	if err != nil || string(b) != `{"Threads":3,"Timeout":"1.5s","Retries":1,"Rate":2.5}` {
+		t.Errorf("Unexpected JSON: %s, error: %+v", b, err)
+	}
+	s2 := Settings{}
+	if err := json.Unmarshal(b, &s2); err != nil || s2 != s {
+		t.Errorf("Unexpected settings: %+v, error: %+v", s2, err)
+	}
+}
+
+// TestScanRate validates that probes are paced when a rate is set.
+func TestScanRate(t *testing.T) {
+	ips := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}
+	start := time.Now()
+	Scan(context.Background(), "9999", ips, Settings{Threads: 4, Timeout: time.Second, Rate: 20}, nil)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Scan was not rate limited, elapsed: %s", elapsed)
+	}
+}
+
+// TestOverride validates individual settings can be overridden, and are validated.
+func TestOverride(t *testing.T) {
+	s := Profiles[DefaultProfile]
+	overrides := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"threads", "5", true}, {"threads", "0", false}, {"timeout", "500ms", true}, {"timeout", "3", true},
+		{"timeout", "0", false}, {"retries", "2", true}, {"retries", "-1", false}, {"rate", "2.5", true},
+		{"rate", "fast", false}, {"rate", "2e9", false}, {"rate", "1e-12", false}, {"rate", "NaN", false},
+		{"rate", "+Inf", false}, {"color", "blue", false}}
+	for _, v := range overrides {
+		o, err := s.Override(v.name, v.value)
+		if (err == nil) != v.ok {
+			t.Errorf("Unexpected override result for %+v, error: %+v", v, err)
+		}
+		if err == nil {
+			s = o
+		}
+	}
+	expected := Settings{Threads: 5, Timeout: 3 * time.Second, Retries: 2, Rate: 2.5}
+	if s != expected {
+		t.Errorf("Unexpected settings after overrides: %+v", s)
+	}
+}
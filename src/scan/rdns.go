@@ -0,0 +1,105 @@
+package scan
+
+// rdns.go enriches scan results with hostnames from reverse DNS (PTR) lookups.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLookupConcurrency is the number of concurrent reverse lookups used when none is specified.
+	DefaultLookupConcurrency = 10
+	// lookupTimeout is the timeout for each reverse lookup.
+	lookupTimeout = 5 * time.Second
+	// dnsPort is appended to a resolver address without a port.
+	dnsPort = "53"
+
+	InvalidRDNS = "Invalid reverse DNS entry. Must be on or off."
+)
+
+// NewResolver returns a resolver that sends queries to the DNS server at server (host or host:port,
+// port defaults to 53). An empty server returns the system resolver.
+func NewResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), dnsPort)
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver address %s, error: %+v", server, err)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid resolver address %s", server)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// Responded returns true if the target answered the probe, either accepting or refusing the connection.
+func (r Result) Responded() bool {
+	return r.Error != nil && (*r.Error == NoError || strings.Contains(*r.Error, "connection refused"))
+}
+
+// ReverseLookup sets Hostname on each of results whose target responded, using resolver with up
+// to concurrency lookups at once. Each IP is looked up once; IPs with no PTR record, or whose lookup
+// fails, are left without a Hostname.
+func ReverseLookup(ctx context.Context, results Results, resolver *net.Resolver, concurrency int) {
+	if concurrency < 1 {
+		concurrency = DefaultLookupConcurrency
+	}
+	indexes := make(map[string][]int)
+	for i := range results {
+		if results[i].Responded() {
+			indexes[results[i].IP] = append(indexes[results[i].IP], i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	for ip, idx := range indexes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string, idx []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			lctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+			defer cancel()
+			names, err := resolver.LookupAddr(lctx, strings.Trim(ip, "[]"))
+			if err != nil || len(names) == 0 {
+				return
+			}
+			lock.Lock()
+			for _, i := range idx {
+				results[i].Hostname = strings.TrimSuffix(names[0], ".")
+			}
+			lock.Unlock()
+		}(ip, idx)
+	}
+	wg.Wait()
+}
+
+// ValidateRDNS will validate a reverse DNS entry of on or off.
+func ValidateRDNS(rdns string) (bool, error) {
+	switch strings.ToLower(rdns) {
+	case "on", "true":
+		return true, nil
+	case "off", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s", InvalidRDNS)
+}
@@ -0,0 +1,36 @@
+package scan
+
+import (
+	"context"
+	"testing"
+)
+
+// TestReverseLookup validates that only targets that responded are looked up.
+// The system resolver is expected to resolve 127.0.0.1 from the hosts file.
+func TestReverseLookup(t *testing.T) {
+	refused := "dial tcp 127.0.0.1:9999: connect: connection refused"
+	ns := NotScanned
+	results := Results{{IP: "127.0.0.1", Port: "9999", Error: &refused},
+		{IP: "127.0.0.1", Port: "9999", Error: &ns}}
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("Error creating resolver: %+v", err)
+	}
+	ReverseLookup(context.Background(), results, resolver, 2)
+	if results[0].Hostname == "" || results[1].Hostname != "" {
+		t.Errorf("Unexpected hostnames: %+v", results)
+	}
+}
+
+// TestNewResolver validates resolver addresses.
+func TestNewResolver(t *testing.T) {
+	// resolverMap is a map of address/should_pass pairs
+	resolverMap := map[string]bool{"": true, "9.9.9.9": true, "9.9.9.9:5353": true, "::1": true,
+		"[::1]:53": true, "a:b:c": false}
+	for k, v := range resolverMap {
+		_, err := NewResolver(k)
+		if (err == nil) != v {
+			t.Errorf("Unexpected result for resolver %s, error: %+v", k, err)
+		}
+	}
+}
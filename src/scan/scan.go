@@ -3,11 +3,14 @@
 package scan
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -15,12 +18,144 @@ type ID struct {
 	ID string
 }
 
+// Request is the request body to start a scan using the portscanservice v2 API. Budget, Profile,
+// RDNS, TTL and Priority are optional, and are the same as the setbudget, setprofile, setrdns,
+// setttl and setpriority query keys. Threads, Timeout, Retries and Rate are optional overrides of
+// the settings of the profile, and are the same as the setthreads, settimeout, setretries and
+// setrate query keys. Webhook is an optional http or https URL that a WebhookEvent is POSTed to
+// when the scan is done.
+type Request struct {
+	IPs      []string
+	Port     string
+	Budget   string `json:",omitempty"`
+	Profile  string `json:",omitempty"`
+	Threads  string `json:",omitempty"`
+	Timeout  string `json:",omitempty"`
+	Retries  string `json:",omitempty"`
+	Rate     string `json:",omitempty"`
+	RDNS     bool   `json:",omitempty"`
+	TTL      string `json:",omitempty"`
+	Priority string `json:",omitempty"`
+	Webhook  string `json:",omitempty"`
+}
+
+// ScheduleRequest is the request body to create a recurring scan using the portscanservice v2 API.
+// Exactly one of Cron, a 5 field cron expression (minute hour day-of-month month day-of-week, in
+// the service's time zone), or Interval, a duration (I.E. 24h) of at least a minute, is required.
+// Webhook is an optional URL that a WebhookEvent is POSTed to when each run is done, and when a run
+// finds changes from the previous completed run.
+type ScheduleRequest struct {
+	Cron     string `json:",omitempty"`
+	Interval string `json:",omitempty"`
+	Webhook  string `json:",omitempty"`
+	Scan     Request
+}
+
+// Schedule is a recurring scan as returned by the portscanservice v2 API. Each run is a Job with
+// the ScheduleID of the schedule. A run is skipped if the previous run is not done.
+type Schedule struct {
+	ID string
+	ScheduleRequest
+	Paused  bool
+	Created time.Time
+	// LastRun and LastJobID are the time and job of the last run; zero before the first run.
+	LastRun   time.Time
+	LastJobID string `json:",omitempty"`
+	// NextRun is when the next run is due; zero while paused.
+	NextRun time.Time
+	// Skipped is the number of runs skipped, because the previous run was not done or the service
+	// was at capacity.
+	Skipped int
+	// Jobs are the IDs of the runs that have not been removed, oldest first; only included when
+	// requesting a single schedule.
+	Jobs []string `json:",omitempty"`
+}
+
+// Job is a scan as returned by the portscanservice status query and v2 API. Results are only
+// included when requesting a single job, and are partial until it is Done.
+type Job struct {
+	ID string
+	// State is one of the Job* states.
+	State    string
+	Created  time.Time
+	Finished time.Time
+	// Expires is when the job and its results will be removed; set once the job is Done.
+	Expires time.Time
+	// Error is set when State is JobFailed.
+	Error string `json:",omitempty"`
+	// Priority is one of the Priority* priorities.
+	Priority string
+	// ScheduleID is the ID of the Schedule that started the job, if any.
+	ScheduleID string `json:",omitempty"`
+	// Position is the 1 based position of a queued job in the queue; 1 runs next. Zero once the
+	// job is running.
+	Position int `json:",omitempty"`
+	Progress
+	// Partial is true when Results are those collected so far for a job that is not Done;
+	// Progress.Percent indicates how complete they are.
+	Partial bool
+	Results Results `json:",omitempty"`
+}
+
+// Job states, as reported by portscanservice. A job is queued when requested, running once
+// probes are being sent, and then ends in one of the remaining states. A queued or running job
+// may be paused, and then resumed.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobPaused    = "paused"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job priorities. Queued interactive jobs run before batch jobs, and running interactive jobs
+// are granted more of the service's workers than batch jobs. A request that does not specify a
+// priority is given one by the service, by the number of targets.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// APIError is the body of portscanservice v2 API error responses.
+type APIError struct {
+	Error string
+}
+
 type Results []Result
 
 type Result struct {
 	IP    string
 	Port  string
 	Error *string
+	// Hostname is set by ReverseLookup.
+	Hostname string `json:",omitempty"`
+}
+
+// Progress is the progress of a scan; Scan reports it after each probe completes.
+type Progress struct {
+	// Completed is the number of probes completed, of Total probes.
+	Completed int
+	Total     int
+	// Percent is Completed as a percentage of Total.
+	Percent float64
+	// Rate is the number of probes completed per second since Started.
+	Rate    float64
+	Started time.Time
+	// ETA is the estimated finish time; zero until a rate is known.
+	ETA time.Time
+}
+
+// ProgressFunc receives Progress from Scan, and the Result of the probe that completed.
+// Calls are made from a single goroutine.
+type ProgressFunc func(Progress, Result)
+
+// Limiter limits the connection attempts in flight across all scans sharing it. Acquire blocks
+// until an attempt may start, returning an error only if ctx is done first; each successful
+// Acquire is followed by a Release once the attempt completes.
+type Limiter interface {
+	Acquire(ctx context.Context) error
+	Release()
 }
 
 // The constants in this section are used by portscan and portscanservice, and may not be used
@@ -32,20 +167,32 @@ const (
 	// putting in a hardcoded value.
 	DefaultServicePort = "8000"
 
+	InvalidBudget     = "Invalid budget entry. Must be a duration (I.E. 5m, 30s) or integer seconds >= 0; 0 for no budget."
 	InvalidIPsCLI     = "Invalid IP entry. Must be a space delimited list of IP addresses."
 	InvalidIPsService = "Invalid IP entry. Must be a CSV list of IP addresses."
 	InvalidPort       = "Invalid port entry. Must be an integer [0, 65535]"
+	InvalidPriority   = "Invalid priority entry. Must be interactive or batch."
 	MissingPort       = "No port set; call SetPort to set the target port."
 	MissingIPs        = "No IPs set; call setIPs to set the target IP addresses."
 	ShowIPs           = "Current IPs: "
+	ShowNoScan        = "No scan has been executed."
 	ShowPort          = "Current port: "
 
 	NoError = "none"
+	// NotScanned is the Error for targets that were not probed because the scan budget ran out.
+	NotScanned = "not scanned"
 
 	// ServiceAppName is returned in ServerHeader so callers know they are talking to this service.
 	ServiceAppName = "portscanservice"
 	// ServiceHeader returns AppName, see above.
 	ServiceHeader = "Server"
+	// PartialHeader is set to true when results are returned for a scan that is not done, in which
+	// case PercentHeader is the percent of probes completed.
+	PartialHeader = "X-Portscan-Partial"
+	PercentHeader = "X-Portscan-Percent"
+	// CursorHeader is set when a limit is requested and there are more results; request the next
+	// page with the query key cursor set to its value.
+	CursorHeader = "X-Portscan-Next-Cursor"
 )
 
 const (
@@ -62,6 +209,9 @@ func (sr Results) String() string {
 	out := ""
 	for i := range sr {
 		out += fmt.Sprintf("IP:  %-15s| Port: %-5s| ", sr[i].IP, sr[i].Port)
+		if sr[i].Hostname != "" {
+			out += fmt.Sprintf("Host: %-30s| ", sr[i].Hostname)
+		}
 		if sr[i].Error == nil {
 			out += fmt.Sprintf("Error: none\n")
 		} else {
@@ -71,51 +221,169 @@ func (sr Results) String() string {
 	return out
 }
 
-// Scan performs a port scan of the provided port (string with no leading ":"), IPs, in
-// the specified number of threads (asynchronous processes), with the specified timeout (seconds).
-// Inputs should be validated prior to calling using ValidatePort and ValidateIPs. (Validation
-// is done separately to allow callers to verify data when supplied by the user, so the user
-// can be notified at that point and the problem corrected.)
-func Scan(port string, ips []string, threads int, timeout time.Duration) Results {
-	results := make([]Result, len(ips))
+// Done returns true if the job is in a final state; completed, failed or cancelled.
+func (j Job) Done() bool {
+	return j.State == JobCompleted || j.State == JobFailed || j.State == JobCancelled
+}
+
+func (j Job) String() string {
+	out := fmt.Sprintf("ID: %s, State: %s, Priority: %s, %s", j.ID, j.State, j.Priority, j.Progress)
+	if j.Position > 0 {
+		out += fmt.Sprintf(", Queue position: %d", j.Position)
+	}
+	if j.Error != "" {
+		out += fmt.Sprintf(", Error: %s", j.Error)
+	}
+	return out
+}
+
+// NewProgress returns the Progress of a scan of total probes started at started, with
+// completed probes done as of now.
+func NewProgress(completed int, total int, started time.Time, now time.Time) Progress {
+	p := Progress{Completed: completed, Total: total, Started: started, Percent: 100}
+	if total > 0 {
+		p.Percent = 100 * float64(completed) / float64(total)
+	}
+	elapsed := now.Sub(started).Seconds()
+	if elapsed > 0 && completed > 0 {
+		p.Rate = float64(completed) / elapsed
+		remaining := time.Duration(float64(total-completed) / p.Rate * float64(time.Second))
+		p.ETA = now.Add(remaining)
+	}
+	return p
+}
+
+func (p Progress) String() string {
+	out := fmt.Sprintf("Progress: %d/%d (%.1f%%), %.1f probes/s", p.Completed, p.Total, p.Percent, p.Rate)
+	if !p.ETA.IsZero() {
+		out += fmt.Sprintf(", ETA %s", p.ETA.Format("15:04:05"))
+	}
+	return out
+}
+
+// Scan performs a port scan of the provided port (string with no leading ":"), IPs, using
+// the specified settings; settings.Threads is the number of asynchronous processes.
+// Inputs should be validated prior to calling using ValidatePort, ValidateIPs and
+// Settings.Validate. (Validation is done separately to allow callers to verify data when
+// supplied by the user, so the user can be notified at that point and the problem corrected.)
+// If progress is not nil, it is called after each probe completes.
+// Once ctx is done no further probes are issued, and connects in progress are abandoned; targets
+// not yet probed are returned with Error NotScanned. Use context.WithTimeout to limit the time for the whole scan.
+func Scan(ctx context.Context, port string, ips []string, settings Settings, progress ProgressFunc) Results {
+	results := make([]Result, 0, len(ips))
 	resultChan := make(chan Result, len(ips))
 	var wg sync.WaitGroup
 	tasks := make(chan string, len(ips))
-	for i := 0; i < threads; i++ {
+	// tick paces probes across all threads when a rate is set.
+	var tick <-chan time.Time
+	if settings.Rate > 0 {
+		ticker := time.NewTicker(settings.interval())
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; i < settings.Threads; i++ {
 		wg.Add(1)
-		go func(taskChan <-chan string, port string, rslt chan<- Result, tout time.Duration) {
+		go func(taskChan <-chan string, port string, rslt chan<- Result) {
 			for ip := range taskChan {
-				addr := ip + ":" + port
-				conn, err := net.DialTimeout(networkType, addr, tout)
-				if err != nil {
-					es := fmt.Sprintf("%+v", err)
-					rslt <- Result{IP: ip, Port: port, Error: &es}
-					continue
-				}
-				conn.Close()
-				none := NoError
-				rslt <- Result{IP: ip, Port: port, Error: &none}
+				rslt <- probe(ctx, ip, port, settings, tick)
 			}
 			wg.Done()
-		}(tasks, port, resultChan, timeout)
+		}(tasks, port, resultChan)
 	}
 
+	started := time.Now()
 	for i := range ips {
 		tasks <- ips[i]
 	}
 	close(tasks)
 
-	wg.Wait()
-	close(resultChan)
-	index := 0
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
 	for r := range resultChan {
-		results[index] = r
-		index++
+		results = append(results, r)
+		if progress != nil {
+			progress(NewProgress(len(results), len(ips), started, time.Now()), r)
+		}
 	}
 
 	return results
 }
 
+// probe connects to ip:port, retrying a connection that fails for a reason other than being
+// refused up to settings.Retries times. If tick is not nil, each attempt waits for it; if
+// settings.Limiter is not nil, each attempt holds it while connecting.
+func probe(ctx context.Context, ip string, port string, settings Settings, tick <-chan time.Time) Result {
+	var err error
+	for attempt := 0; attempt <= settings.Retries; attempt++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil || (settings.Limiter != nil && settings.Limiter.Acquire(ctx) != nil) {
+			if attempt == 0 {
+				ns := NotScanned
+				return Result{IP: ip, Port: port, Error: &ns}
+			}
+			break
+		}
+
+		conn, dialErr := (&net.Dialer{Timeout: settings.Timeout}).DialContext(ctx, networkType, ip+":"+port)
+		if settings.Limiter != nil {
+			settings.Limiter.Release()
+		}
+		if dialErr == nil {
+			conn.Close()
+			none := NoError
+			return Result{IP: ip, Port: port, Error: &none}
+		}
+		// A connect abandoned as ctx is done did not probe the target; keep any earlier error.
+		if ctx.Err() != nil {
+			if attempt == 0 {
+				ns := NotScanned
+				return Result{IP: ip, Port: port, Error: &ns}
+			}
+			break
+		}
+		err = dialErr
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+	}
+	es := fmt.Sprintf("%+v", err)
+	return Result{IP: ip, Port: port, Error: &es}
+}
+
+// ParseDuration parses a duration (I.E. "5m") or integer seconds.
+func ParseDuration(d string) (time.Duration, error) {
+	if s, err := strconv.Atoi(d); err == nil {
+		return time.Duration(s) * time.Second, nil
+	}
+	return time.ParseDuration(d)
+}
+
+// ValidateBudget will validate a scan budget, provided as a duration (I.E. "5m") or integer
+// seconds. Zero means no budget.
+func ValidateBudget(budget string) (time.Duration, error) {
+	d, err := ParseDuration(budget)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s", InvalidBudget)
+	}
+	return d, nil
+}
+
+// ValidatePriority will validate a priority of interactive or batch, returning it in lower case.
+func ValidatePriority(priority string) (string, error) {
+	priority = strings.ToLower(priority)
+	if priority != PriorityInteractive && priority != PriorityBatch {
+		return "", fmt.Errorf("%s", InvalidPriority)
+	}
+	return priority, nil
+}
+
 // ValidateIPs will validate inputIPs as valid IPv4 or IPv6. If any IP is invalid, no IPs are returned.
 func ValidateIPs(inputIPs []string, cli bool) ([]string, error) {
 	if len(inputIPs) == 0 {
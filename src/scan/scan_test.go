@@ -7,16 +7,17 @@ package scan
 //
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
 
 // Scan is currently implicitly tested by tests in portscan.
 
-const (
-	threads = 10
-	timeout = time.Duration(1) * time.Second
+var (
+	settings = Settings{Threads: 10, Timeout: time.Duration(1) * time.Second}
 )
 
 type IPTest struct {
@@ -38,6 +39,31 @@ func TestValidatePort(t *testing.T) {
 	}
 }
 
+// TestValidateBudget tests the input parsing.
+func TestValidateBudget(t *testing.T) {
+	// budgetMap is a map of budget/expected_duration pairs; -1 is expected to fail.
+	budgetMap := map[string]time.Duration{"0": 0, "30": 30 * time.Second, "5m": 5 * time.Minute,
+		"-1": -1, "-5m": -1, "soon": -1}
+	for k, v := range budgetMap {
+		d, err := ValidateBudget(k)
+		if (err == nil && v == -1) || (err != nil && v != -1) || (err == nil && d != v) {
+			t.Errorf("Budget %s was parsed incorrectly: %v, error: %+v", k, d, err)
+		}
+	}
+}
+
+// TestValidatePriority tests the input parsing.
+func TestValidatePriority(t *testing.T) {
+	// priorityMap is a map of priority/expected pairs; an empty expected value is expected to fail.
+	priorityMap := map[string]string{"interactive": PriorityInteractive, "BATCH": PriorityBatch, "urgent": "", "": ""}
+	for k, v := range priorityMap {
+		p, err := ValidatePriority(k)
+		if (err == nil) != (v != "") || p != v {
+			t.Errorf("Priority %s was parsed incorrectly: %s, error: %+v", k, p, err)
+		}
+	}
+}
+
 // TestValidateIPs tests the input parsing.
 func TestValidateIPs(t *testing.T) {
 	// ipMap is a map of ips/should_pass pairs
@@ -61,7 +87,7 @@ func TestScan(t *testing.T) {
 		{[]string{"127.0.0.1", "::1"}, "9999", 2, 2},
 		{[]string{"127.0.0.1", "8.8.8.8"}, "9999", 2, 2}}
 	for _, v := range ipTest {
-		results := Scan(v.port, v.ips, threads, timeout)
+		results := Scan(context.Background(), v.port, v.ips, settings, nil)
 
 		errors := 0
 		for j := 0; j < len(results); j++ {
@@ -75,3 +101,86 @@ func TestScan(t *testing.T) {
 	}
 	fmt.Println("TestExecute done")
 }
+
+// TestScanProgress validates that progress and the result are reported for every probe.
+func TestScanProgress(t *testing.T) {
+	ips := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	calls := 0
+	var last Progress
+	reported := Results{}
+	Scan(context.Background(), "9999", ips, settings, func(p Progress, r Result) {
+		calls++
+		last = p
+		reported = append(reported, r)
+	})
+	if calls != len(ips) || last.Completed != len(ips) || last.Total != len(ips) || last.Percent != 100 ||
+		len(reported) != len(ips) || reported[0].Port != "9999" {
+		t.Errorf("Unexpected progress, calls: %d, last: %+v, results: %+v", calls, last, reported)
+	}
+}
+
+// TestNewProgress validates the percent, rate and ETA calculations.
+func TestNewProgress(t *testing.T) {
+	started := time.Date(2021, 2, 3, 0, 0, 0, 0, time.UTC)
+	p := NewProgress(25, 100, started, started.Add(5*time.Second))
+	if p.Percent != 25 || p.Rate != 5 || !p.ETA.Equal(started.Add(20*time.Second)) {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+	p = NewProgress(0, 100, started, started)
+	if p.Rate != 0 || !p.ETA.IsZero() {
+		t.Errorf("Unexpected progress with no probes completed: %+v", p)
+	}
+}
+
+// TestScanBudget validates that targets are not probed once the context is done.
+func TestScanBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	results := Scan(ctx, "9999", ips, settings, nil)
+	for _, r := range results {
+		if r.Error == nil || *r.Error != NotScanned {
+			t.Errorf("Unexpected result after budget expired: %+v", results)
+		}
+	}
+	if len(results) != len(ips) {
+		t.Errorf("Unexpected number of results: %+v", results)
+	}
+}
+
+// countingLimiter counts attempts, and records the most in flight at once.
+type countingLimiter struct {
+	mu       sync.Mutex
+	inFlight int
+	most     int
+	acquired int
+}
+
+func (l *countingLimiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight++
+	l.acquired++
+	if l.inFlight > l.most {
+		l.most = l.inFlight
+	}
+	return nil
+}
+
+func (l *countingLimiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+}
+
+// TestScanLimiter validates that every connection attempt holds the limiter.
+func TestScanLimiter(t *testing.T) {
+	l := &countingLimiter{}
+	s := settings
+	s.Limiter = l
+	ips := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	Scan(context.Background(), "9999", ips, s, nil)
+	if l.acquired != len(ips) || l.inFlight != 0 || l.most < 1 {
+		t.Errorf("Unexpected limiter use: %+v", l)
+	}
+}
@@ -0,0 +1,71 @@
+package scan
+
+// stream.go reads the Server-Sent Events stream of a scan from the portscanservice v2 API.
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Events of the stream of a scan.
+const (
+	// StreamState data is the Job, without results; sent when the stream starts and when the
+	// state or queue position of the job changes.
+	StreamState = "state"
+	// StreamProgress data is the Progress of the job.
+	StreamProgress = "progress"
+	// StreamResult data is a Result; the event ID is the index of the result.
+	StreamResult = "result"
+	// StreamDone data is the Job, without results, once it is done; the stream then ends.
+	StreamDone = "done"
+)
+
+// StreamEvent is an event read from a Server-Sent Events stream.
+type StreamEvent struct {
+	Event string
+	ID    string
+	Data  string
+}
+
+// ReadStream reads Server-Sent Events from r, calling f with each event, until r is exhausted or f
+// returns false. Comments are skipped, and data lines of an event are joined with newlines.
+func ReadStream(r io.Reader, f func(StreamEvent) bool) error {
+	scanner := bufio.NewScanner(r)
+	// Results are small, but allow for long hostnames and error strings.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	ev := StreamEvent{}
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				ev.Data = strings.Join(data, "\n")
+				if ev.Event == "" {
+					ev.Event = "message"
+				}
+				if !f(ev) {
+					return nil
+				}
+			}
+			ev, data = StreamEvent{}, []string{}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			ev.Event = value
+		case "id":
+			ev.ID = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,31 @@
+package scan
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestReadStream validates parsing of events, comments and multi-line data.
+func TestReadStream(t *testing.T) {
+	stream := ": keepalive\n\n" +
+		"event: state\ndata: {\"State\":\"running\"}\n\n" +
+		"event: result\nid: 0\ndata: line 1\ndata: line 2\n\n" +
+		"data: no event\n\n" +
+		"event: done\ndata: {}\n\n" +
+		"event: ignored\ndata: {}\n\n"
+	expected := []StreamEvent{{StreamState, "", `{"State":"running"}`}, {StreamResult, "0", "line 1\nline 2"},
+		{"message", "", "no event"}, {StreamDone, "", "{}"}}
+	events := []StreamEvent{}
+	err := ReadStream(strings.NewReader(stream), func(ev StreamEvent) bool {
+		events = append(events, ev)
+		return ev.Event != StreamDone
+	})
+	if err != nil || len(events) != len(expected) {
+		t.Fatalf("Unexpected events: %+v, error: %+v", events, err)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("Unexpected event: %+v, expected: %+v", events[i], expected[i])
+		}
+	}
+}
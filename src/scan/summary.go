@@ -0,0 +1,189 @@
+package scan
+
+// summary.go summarizes the results of a scan, so the open ports and the reasons others were not
+// open can be seen without reading every Result.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error categories of results that are not open, as counted by Summary.Errors.
+const (
+	ErrorRefused     = "refused"
+	ErrorTimeout     = "timeout"
+	ErrorUnreachable = "unreachable"
+	ErrorReset       = "reset"
+	ErrorOther       = "other"
+)
+
+// SummaryTopPorts is the maximum number of Summary.TopPorts.
+const SummaryTopPorts = 10
+
+// Summary summarizes the results of a scan, as returned by Summarize.
+type Summary struct {
+	// ID is the ID of the job, when summarized by portscanservice; Partial is true while the job
+	// is not Done.
+	ID      string `json:",omitempty"`
+	Partial bool   `json:",omitempty"`
+	// Results is the number of results, and States the number in each State* state.
+	Results int
+	States  map[string]int
+	// Hosts is the number of distinct IPs; OpenHosts are those with open ports, ordered by IP.
+	Hosts     int
+	OpenHosts []HostPorts `json:",omitempty"`
+	// TopPorts are the ports open on the most hosts, most first, up to SummaryTopPorts.
+	TopPorts []PortCount `json:",omitempty"`
+	// Errors is the number of results in each Error* category; open and not scanned results
+	// are not counted.
+	Errors map[string]int `json:",omitempty"`
+	// Started and Finished are the start and end of the scan; Finished is zero while running.
+	Started  time.Time
+	Finished time.Time
+	// Seconds is the time from Started to Finished, or to now while running, and Rate is the
+	// number of probes completed per second over that time.
+	Seconds float64
+	Rate    float64
+}
+
+// HostPorts are the open ports of a host.
+type HostPorts struct {
+	IP       string
+	Hostname string `json:",omitempty"`
+	Ports    []string
+}
+
+// PortCount is the number of hosts a port is open on.
+type PortCount struct {
+	Port  string
+	Hosts int
+}
+
+// ErrorCategory returns the Error* category of the Error of r, or an empty string if r is open or
+// was not scanned.
+func (r Result) ErrorCategory() string {
+	if r.Error == nil || *r.Error == NoError || *r.Error == NotScanned {
+		return ""
+	}
+	e := *r.Error
+	switch {
+	case strings.Contains(e, "connection refused"):
+		return ErrorRefused
+	case strings.Contains(e, "timeout"):
+		return ErrorTimeout
+	case strings.Contains(e, "no route to host"), strings.Contains(e, "network is unreachable"),
+		strings.Contains(e, "host is down"):
+		return ErrorUnreachable
+	case strings.Contains(e, "connection reset"):
+		return ErrorReset
+	}
+	return ErrorOther
+}
+
+// Summarize returns the Summary of results, of a scan that ran from started to finished; finished
+// is zero for a scan that is still running.
+func Summarize(results Results, started time.Time, finished time.Time) Summary {
+	s := Summary{Results: len(results), States: make(map[string]int), Errors: make(map[string]int),
+		Started: started, Finished: finished}
+	open := make(map[string]*HostPorts)
+	hosts := make(map[string]bool)
+	portHosts := make(map[string]int)
+	completed := 0
+	for _, r := range results {
+		state := r.State()
+		s.States[state]++
+		hosts[r.IP] = true
+		if state != StateNotScanned {
+			completed++
+		}
+		if c := r.ErrorCategory(); c != "" {
+			s.Errors[c]++
+		}
+		if state != StateOpen {
+			continue
+		}
+		h, ok := open[r.IP]
+		if !ok {
+			h = &HostPorts{IP: r.IP}
+			open[r.IP] = h
+		}
+		if r.Hostname != "" {
+			h.Hostname = r.Hostname
+		}
+		h.Ports = append(h.Ports, r.Port)
+		portHosts[r.Port]++
+	}
+	s.Hosts = len(hosts)
+
+	for _, h := range open {
+		sort.Slice(h.Ports, func(i, k int) bool { return PortLess(h.Ports[i], h.Ports[k]) })
+		s.OpenHosts = append(s.OpenHosts, *h)
+	}
+	sort.Slice(s.OpenHosts, func(i, k int) bool { return IPLess(s.OpenHosts[i].IP, s.OpenHosts[k].IP) })
+
+	for p, n := range portHosts {
+		s.TopPorts = append(s.TopPorts, PortCount{Port: p, Hosts: n})
+	}
+	sort.Slice(s.TopPorts, func(i, k int) bool {
+		if s.TopPorts[i].Hosts != s.TopPorts[k].Hosts {
+			return s.TopPorts[i].Hosts > s.TopPorts[k].Hosts
+		}
+		return PortLess(s.TopPorts[i].Port, s.TopPorts[k].Port)
+	})
+	if len(s.TopPorts) > SummaryTopPorts {
+		s.TopPorts = s.TopPorts[:SummaryTopPorts]
+	}
+
+	if !started.IsZero() {
+		end := finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		s.Seconds = end.Sub(started).Seconds()
+		if s.Seconds > 0 {
+			s.Rate = float64(completed) / s.Seconds
+		}
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	out := ""
+	if s.ID != "" {
+		out += fmt.Sprintf("ID: %s\n", s.ID)
+	}
+	if s.Partial {
+		out += "Partial; the scan is not done.\n"
+	}
+	out += fmt.Sprintf("Results: %d, Hosts: %d, Open: %d, Closed: %d, Filtered: %d, Not scanned: %d\n",
+		s.Results, s.Hosts, s.States[StateOpen], s.States[StateClosed], s.States[StateFiltered], s.States[StateNotScanned])
+	if s.Seconds > 0 {
+		out += fmt.Sprintf("Duration: %s, Rate: %.1f/s\n", time.Duration(s.Seconds*float64(time.Second)).Round(time.Microsecond), s.Rate)
+	}
+	if len(s.Errors) > 0 {
+		errs := []string{}
+		for _, c := range []string{ErrorRefused, ErrorTimeout, ErrorUnreachable, ErrorReset, ErrorOther} {
+			if s.Errors[c] > 0 {
+				errs = append(errs, fmt.Sprintf("%s: %d", c, s.Errors[c]))
+			}
+		}
+		out += fmt.Sprintf("Errors: %s\n", strings.Join(errs, ", "))
+	}
+	if len(s.TopPorts) > 0 {
+		ports := []string{}
+		for _, p := range s.TopPorts {
+			ports = append(ports, fmt.Sprintf("%s (%d)", p.Port, p.Hosts))
+		}
+		out += fmt.Sprintf("Top open ports: %s\n", strings.Join(ports, ", "))
+	}
+	for _, h := range s.OpenHosts {
+		host := fmt.Sprintf("IP:  %-15s| ", h.IP)
+		if h.Hostname != "" {
+			host += fmt.Sprintf("Host: %-30s| ", h.Hostname)
+		}
+		out += fmt.Sprintf("%sOpen: %s\n", host, strings.Join(h.Ports, ", "))
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package scan
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestErrorCategory validates the category derived from the Error of results.
+func TestErrorCategory(t *testing.T) {
+	// categoryMap is a map of Error/category pairs.
+	categoryMap := map[string]string{NoError: "", NotScanned: "",
+		"dial tcp 10.0.0.1:22: connect: connection refused":     ErrorRefused,
+		"dial tcp 10.0.0.1:22: i/o timeout":                     ErrorTimeout,
+		"dial tcp 10.0.0.1:22: connect: no route to host":       ErrorUnreachable,
+		"dial tcp 10.0.0.1:22: connect: network is unreachable": ErrorUnreachable,
+		"read tcp 10.0.0.1:22: read: connection reset by peer":  ErrorReset,
+		"dial tcp 10.0.0.1:22: socket: too many open files":     ErrorOther,
+	}
+	for k, v := range categoryMap {
+		e := k
+		if c := (Result{Error: &e}).ErrorCategory(); c != v {
+			t.Errorf("Unexpected category for error %q: %s, expected: %s", k, c, v)
+		}
+	}
+}
+
+// TestSummarize validates the counts, open hosts, top ports and rate of a summary.
+func TestSummarize(t *testing.T) {
+	open, refused, timeout, ns := NoError, "connect: connection refused", "i/o timeout", NotScanned
+	results := Results{
+		{IP: "10.0.0.10", Port: "443", Error: &open, Hostname: "web"},
+		{IP: "10.0.0.10", Port: "80", Error: &open},
+		{IP: "10.0.0.2", Port: "22", Error: &open},
+		{IP: "10.0.0.2", Port: "443", Error: &open},
+		{IP: "10.0.0.3", Port: "22", Error: &timeout},
+		{IP: "10.0.0.3", Port: "443", Error: &refused},
+		{IP: "10.0.0.4", Port: "22", Error: &ns},
+	}
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := Summarize(results, started, started.Add(2*time.Second))
+	if s.Results != 7 || s.Hosts != 4 || s.States[StateOpen] != 4 || s.States[StateClosed] != 1 ||
+		s.States[StateFiltered] != 1 || s.States[StateNotScanned] != 1 {
+		t.Errorf("Unexpected counts: %+v", s)
+	}
+	if len(s.Errors) != 2 || s.Errors[ErrorRefused] != 1 || s.Errors[ErrorTimeout] != 1 {
+		t.Errorf("Unexpected errors: %+v", s.Errors)
+	}
+	if len(s.OpenHosts) != 2 || s.OpenHosts[0].IP != "10.0.0.2" || s.OpenHosts[1].Hostname != "web" ||
+		strings.Join(s.OpenHosts[1].Ports, ",") != "80,443" {
+		t.Errorf("Unexpected open hosts: %+v", s.OpenHosts)
+	}
+	if len(s.TopPorts) != 3 || s.TopPorts[0] != (PortCount{Port: "443", Hosts: 2}) || s.TopPorts[1].Port != "22" {
+		t.Errorf("Unexpected top ports: %+v", s.TopPorts)
+	}
+	if s.Seconds != 2 || s.Rate != 3 {
+		t.Errorf("Unexpected duration: %f, rate: %f", s.Seconds, s.Rate)
+	}
+	if out := s.String(); !strings.Contains(out, "Top open ports: 443 (2), 22 (1), 80 (1)") ||
+		!strings.Contains(out, "Errors: refused: 1, timeout: 1") {
+		t.Errorf("Unexpected string: %s", out)
+	}
+
+	s = Summarize(Results{}, time.Time{}, time.Time{})
+	if s.Results != 0 || s.OpenHosts != nil || s.Seconds != 0 || s.Rate != 0 {
+		t.Errorf("Unexpected empty summary: %+v", s)
+	}
+}
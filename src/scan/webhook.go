@@ -0,0 +1,49 @@
+package scan
+
+// webhook.go defines the events portscanservice POSTs to webhook URLs, and their signature.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Webhook events. A job that is done sends the event of its final state.
+const (
+	EventCompleted = JobCompleted
+	EventFailed    = JobFailed
+	EventCancelled = JobCancelled
+	// EventChanged is sent to the webhook of a schedule when a run finds ports that changed state
+	// since the previous completed run.
+	EventChanged = "changed"
+)
+
+// Webhook delivery headers.
+const (
+	// EventHeader is the Event of the WebhookEvent in the body.
+	EventHeader = "X-Portscan-Event"
+	// DeliveryHeader is a unique ID for each event; retries of a delivery have the same ID.
+	DeliveryHeader = "X-Portscan-Delivery"
+	// SignatureHeader is the WebhookSignature of the body, when the service has a webhook secret.
+	SignatureHeader = "X-Portscan-Signature"
+)
+
+// WebhookEvent is the body POSTed to webhook URLs.
+type WebhookEvent struct {
+	// Event is one of the Event* events.
+	Event string
+	Time  time.Time
+	// Job is the scan the event is for, without results; get the results from the v2 API.
+	Job Job
+	// Diff is the change from the previous completed run of the schedule, for EventChanged.
+	Diff *ResultsDiff `json:",omitempty"`
+}
+
+// WebhookSignature returns the signature of a webhook body: "sha256=" followed by the hex encoded
+// HMAC-SHA256 of body using secret. Receivers should compare signatures with hmac.Equal.
+func WebhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,14 @@
+package scan
+
+import (
+	"testing"
+)
+
+// TestWebhookSignature validates the signature against a known HMAC-SHA256.
+func TestWebhookSignature(t *testing.T) {
+	// From RFC 4231, test case 2.
+	expected := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if sig := WebhookSignature([]byte("Jefe"), []byte("what do ya want for nothing?")); sig != expected {
+		t.Errorf("Unexpected signature: %s, expected: %s", sig, expected)
+	}
+}